@@ -35,6 +35,7 @@ func dumpBinlog(file *os.File, from uint32, to uint32) (err error) {
 	file.Seek(int64(from), 0)
 	var n int64
 	pos := from
+	hasChecksum := false
 
 	for {
 		buffer[0] = '\x00'
@@ -46,7 +47,25 @@ func dumpBinlog(file *os.File, from uint32, to uint32) (err error) {
 		var event mysql.BinlogEventPacket
 		event.FromBuffer(buffer[:])
 		event.PacketLength = event.EventSize + 1 //
+		event.BodyLength = int(event.EventSize) - mysql.BinlogEventHeaderSize
+		event.HasChecksum = hasChecksum
 		fmt.Printf("@%d %s\n", pos, event.String())
+		buffered := mysql.BinlogEventHeaderSize + 1
+		switch event.EventType {
+		case mysql.FORMAT_DESCRIPTION_EVENT, mysql.GTID_EVENT, mysql.ANONYMOUS_GTID_EVENT, mysql.PREVIOUS_GTIDS_EVENT:
+			if int(event.PacketLength) > len(buffer) {
+				break
+			}
+			_, err = io.ReadFull(file, buffer[buffered:event.PacketLength])
+			if err != nil {
+				return
+			}
+			buffered = int(event.PacketLength)
+			hasChecksum, err = printEvent(&event, buffer[:], hasChecksum)
+			if err != nil {
+				return
+			}
+		}
 		//if event.LogPos != 0 && event.LogPos-event.EventSize != pos {
 		//err = fmt.Errorf("bad pos: pos: %d, LogPos: %d, EventSize: %d", pos, event.LogPos, event.EventSize) //mysql.BuildErrPacket(mysql.ER_BINLOG_LOGGING_IMPOSSIBLE, "")
 		//return
@@ -56,7 +75,7 @@ func dumpBinlog(file *os.File, from uint32, to uint32) (err error) {
 			return
 		}
 
-		reader := event.GetReader(file, buffer[:mysql.BinlogEventHeaderSize+1])
+		reader := event.GetReader(file, buffer[:buffered])
 		reader.Read(buffer[0:1])
 
 		dumper := hex.Dumper(os.Stdout)
@@ -79,3 +98,32 @@ func dumpBinlog(file *os.File, from uint32, to uint32) (err error) {
 	}
 	return
 }
+
+func printEvent(event *mysql.BinlogEventPacket, buffer []byte, hasChecksum bool) (bool, error) {
+	switch event.EventType {
+	case mysql.FORMAT_DESCRIPTION_EVENT:
+		var fde mysql.FormatDescriptionEvent
+		err := fde.Parse(event, buffer)
+		if err != nil {
+			return hasChecksum, err
+		}
+		fmt.Printf("server version: %s, checksum: %d\n", fde.MysqlServerVersion, fde.ChecksumAlgorism)
+		return fde.ChecksumAlgorism == 1, nil
+	case mysql.GTID_EVENT, mysql.ANONYMOUS_GTID_EVENT:
+		var gtid mysql.GtidEvent
+		err := gtid.Parse(event, buffer)
+		if err != nil {
+			return hasChecksum, err
+		}
+		fmt.Printf("gtid: %s, last_committed: %d, sequence_number: %d, commit_flag: %d\n",
+			gtid.Gtid.String(), gtid.LastCommitted, gtid.SequenceNumber, gtid.CommitFlag)
+	case mysql.PREVIOUS_GTIDS_EVENT:
+		var previousGtids mysql.PreviousGtidsEvent
+		err := previousGtids.Parse(event, buffer)
+		if err != nil {
+			return hasChecksum, err
+		}
+		fmt.Printf("previous gtids: %s\n", previousGtids.Gtids.String())
+	}
+	return hasChecksum, nil
+}
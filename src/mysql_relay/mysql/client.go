@@ -19,6 +19,9 @@ type Client struct {
 	Conn       net.Conn
 	NetTimeout uint32
 	Buffer     [CLIENT_BUFFER_SIZE]byte
+
+	// @master_binlog_checksum set before dumping, NONE if empty
+	MasterBinlogChecksum string
 }
 
 func (self *Client) Connect() (err error) {
@@ -49,3 +52,36 @@ func (self *Client) Command(command Command) (ret OkPacket, err error) {
 	ret, err = SendCommand(command, self.Conn, self.Buffer[:])
 	return
 }
+
+func (self *Client) Query(query string) (ret ResultSet, err error) {
+	cmdPacket := CommandPacket{Command: &QueryCommand{Query: query}}
+	err = WritePacketTo(&cmdPacket, self.Conn, self.Buffer[:])
+	if err != nil {
+		return
+	}
+	cursor := Cursor{
+		ReadWriter: self.Conn,
+		Buffer:     self.Buffer[:],
+	}
+	err = cursor.BeginRead()
+	if err != nil {
+		return
+	}
+	ret, err = cursor.ToRecordSet()
+	return
+}
+
+// query a single value, such as "SELECT @@GLOBAL.GTID_MODE"
+func (self *Client) QueryValue(query string) (ret Value, err error) {
+	var rs ResultSet
+	rs, err = self.Query(query)
+	if err != nil {
+		return
+	}
+	if len(rs.Rows) == 0 || len(rs.Rows[0].Values) == 0 {
+		ret = NullValue()
+		return
+	}
+	ret = rs.Rows[0].Values[0]
+	return
+}
@@ -73,20 +73,61 @@ type ComRegisterSlave struct {
 	   4              master-id
 	*/
 	ServerId uint32
+	Hostname string
+	User     string
+	Password string
+	Port     uint16
+	Rank     uint32
+	MasterId uint32
 }
 
 func (self *ComRegisterSlave) ToBuffer(buffer []byte) (writen int, err error) {
+	if len(buffer) < 18+len(self.Hostname)+len(self.User)+len(self.Password) {
+		err = BUFFER_NOT_SUFFICIENT
+		return
+	}
 	buffer[0] = byte(COM_REGISTER_SLAVE)
 	binary.LittleEndian.PutUint32(buffer[1:], self.ServerId)
-	for i := range buffer[5:17] {
-		buffer[i] = 0
+	p := 5
+	for _, s := range []string{self.Hostname, self.User, self.Password} {
+		buffer[p] = byte(len(s))
+		p++
+		p += copy(buffer[p:], s)
 	}
-	return 17, nil
+	binary.LittleEndian.PutUint16(buffer[p:], self.Port)
+	binary.LittleEndian.PutUint32(buffer[p+2:], self.Rank)
+	binary.LittleEndian.PutUint32(buffer[p+6:], self.MasterId)
+	writen = p + 10
+	return
 }
 
 func (self *ComRegisterSlave) FromBuffer(buffer []byte) (read int, err error) {
+	if len(buffer) < 5 {
+		err = BAD_PACKET
+		return
+	}
 	self.ServerId = binary.LittleEndian.Uint32(buffer[1:])
-	return 5, nil
+	p := 5
+	var fields [3]string
+	for i := range fields {
+		if p >= len(buffer) || p+1+int(buffer[p]) > len(buffer) {
+			err = BAD_PACKET
+			return
+		}
+		n := int(buffer[p])
+		fields[i] = string(buffer[p+1 : p+1+n])
+		p += 1 + n
+	}
+	self.Hostname, self.User, self.Password = fields[0], fields[1], fields[2]
+	if p+10 > len(buffer) {
+		err = BAD_PACKET
+		return
+	}
+	self.Port = binary.LittleEndian.Uint16(buffer[p:])
+	self.Rank = binary.LittleEndian.Uint32(buffer[p+2:])
+	self.MasterId = binary.LittleEndian.Uint32(buffer[p+6:])
+	read = p + 10
+	return
 }
 
 func (self *ComRegisterSlave) CommandType() byte {
@@ -144,3 +185,102 @@ func SendCommand(command Command, readWriter io.ReadWriter, buffer []byte) (ret
 	ret, err = packet.ToOk()
 	return
 }
+
+const (
+	BINLOG_DUMP_NON_BLOCK   uint16 = 0x0001
+	BINLOG_THROUGH_POSITION        = 0x0002
+	BINLOG_THROUGH_GTID            = 0x0004
+)
+
+type ComBinlogDumpGtid struct {
+	/*
+	   http://dev.mysql.com/doc/internals/en/com-binlog-dump-gtid.html
+	   1              [1e] COM_BINLOG_DUMP_GTID
+	   2              flags
+	   4              server-id
+	   4              binlog-filename-len
+	   string[len]    binlog-filename
+	   8              binlog-pos
+	     if flags & BINLOG_THROUGH_GTID {
+	   4              data-size
+	   string[len]    data
+	     }
+	*/
+	Flags          uint16
+	ServerId       uint32
+	BinlogFilename string
+	BinlogPos      uint64
+	Gtids          GtidSet
+}
+
+func (self *ComBinlogDumpGtid) ToBuffer(buffer []byte) (writen int, err error) {
+	p := 19 + len(self.BinlogFilename)
+	if self.Flags&BINLOG_THROUGH_GTID != 0 {
+		if len(buffer) < p+4+self.Gtids.EncodedLength() {
+			err = BUFFER_NOT_SUFFICIENT
+			return
+		}
+	} else if len(buffer) < p {
+		err = BUFFER_NOT_SUFFICIENT
+		return
+	}
+	buffer[0] = byte(COM_BINLOG_DUMP_GTID)
+	binary.LittleEndian.PutUint16(buffer[1:], self.Flags)
+	binary.LittleEndian.PutUint32(buffer[3:], self.ServerId)
+	binary.LittleEndian.PutUint32(buffer[7:], uint32(len(self.BinlogFilename)))
+	copy(buffer[11:], []byte(self.BinlogFilename))
+	binary.LittleEndian.PutUint64(buffer[11+len(self.BinlogFilename):], self.BinlogPos)
+	if self.Flags&BINLOG_THROUGH_GTID != 0 {
+		n := 0
+		n, err = self.Gtids.ToBuffer(buffer[p+4:])
+		if err != nil {
+			return
+		}
+		binary.LittleEndian.PutUint32(buffer[p:], uint32(n))
+		p += 4 + n
+	}
+	writen = p
+	return
+}
+
+func (self *ComBinlogDumpGtid) FromBuffer(buffer []byte) (read int, err error) {
+	if len(buffer) < 11 {
+		err = BUFFER_NOT_SUFFICIENT
+		return
+	}
+	self.Flags = binary.LittleEndian.Uint16(buffer[1:])
+	self.ServerId = binary.LittleEndian.Uint32(buffer[3:])
+	nameLength := int(binary.LittleEndian.Uint32(buffer[7:]))
+	p := 11 + nameLength
+	if len(buffer) < p+8 {
+		err = BUFFER_NOT_SUFFICIENT
+		return
+	}
+	self.BinlogFilename = string(buffer[11:p])
+	self.BinlogPos = binary.LittleEndian.Uint64(buffer[p:])
+	p += 8
+	self.Gtids = NewGtidSet()
+	if self.Flags&BINLOG_THROUGH_GTID != 0 {
+		if len(buffer) < p+4 {
+			err = BUFFER_NOT_SUFFICIENT
+			return
+		}
+		dataSize := int(binary.LittleEndian.Uint32(buffer[p:]))
+		p += 4
+		if len(buffer) < p+dataSize {
+			err = BUFFER_NOT_SUFFICIENT
+			return
+		}
+		_, err = self.Gtids.FromBuffer(buffer[p : p+dataSize])
+		if err != nil {
+			return
+		}
+		p += dataSize
+	}
+	read = p
+	return
+}
+
+func (self *ComBinlogDumpGtid) CommandType() byte {
+	return COM_BINLOG_DUMP_GTID
+}
@@ -0,0 +1,22 @@
+package mysql
+
+import (
+	"testing"
+)
+
+func TestComRegisterSlave(t *testing.T) {
+	reg := ComRegisterSlave{ServerId: 12, Hostname: "replica-1", User: "repl", Port: 3306, MasterId: 1001}
+	var buffer [64]byte
+	n, err := reg.ToBuffer(buffer[:])
+	if err != nil || n != 18+len(reg.Hostname)+len(reg.User) {
+		t.Fatalf("written %d: %v", n, err)
+	}
+	var decoded ComRegisterSlave
+	read, err := decoded.FromBuffer(buffer[:n])
+	if err != nil || read != n || decoded != reg {
+		t.Errorf("decoded: %v, %v", decoded, err)
+	}
+	if _, err = decoded.FromBuffer(buffer[:n-1]); err == nil {
+		t.Error("truncated packet decoded")
+	}
+}
@@ -0,0 +1,330 @@
+package mysql
+
+import (
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type Sid [16]byte
+
+func ParseSid(s string) (sid Sid, err error) {
+	h := strings.Replace(strings.TrimSpace(s), "-", "", -1)
+	if len(h) != 32 {
+		err = fmt.Errorf("not valid server uuid: %s", s)
+		return
+	}
+	_, err = hex.Decode(sid[:], []byte(h))
+	return
+}
+
+func (self Sid) String() string {
+	h := hex.EncodeToString(self[:])
+	return h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:32]
+}
+
+type Gtid struct {
+	Sid Sid
+	Gno uint64
+}
+
+func (self Gtid) String() string {
+	return fmt.Sprintf("%s:%d", self.Sid.String(), self.Gno)
+}
+
+func (self Gtid) IsEmpty() bool {
+	return self.Gno == 0
+}
+
+// interval of gnos, Stop is excluded as in the binary encoding
+type GtidInterval struct {
+	Start uint64
+	Stop  uint64
+}
+
+func (self GtidInterval) String() string {
+	if self.Stop-self.Start == 1 {
+		return strconv.FormatUint(self.Start, 10)
+	}
+	return fmt.Sprintf("%d-%d", self.Start, self.Stop-1)
+}
+
+// intervals of each sid are kept sorted and merged
+type GtidSet map[Sid][]GtidInterval
+
+func NewGtidSet() GtidSet {
+	return make(GtidSet)
+}
+
+func ParseGtidSet(s string) (ret GtidSet, err error) {
+	/*
+	   3e11fa47-71ca-11e1-9e33-c80aa9429562:1-5:11-18,
+	   2174b383-5441-11e8-b90a-c80aa9429562:1-3
+	*/
+	ret = NewGtidSet()
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return
+	}
+	for _, sidSet := range strings.Split(s, ",") {
+		parts := strings.Split(strings.TrimSpace(sidSet), ":")
+		if len(parts) < 2 {
+			err = fmt.Errorf("not valid gtid set: %s", s)
+			return
+		}
+		var sid Sid
+		sid, err = ParseSid(parts[0])
+		if err != nil {
+			return
+		}
+		for _, part := range parts[1:] {
+			var interval GtidInterval
+			interval, err = parseGtidInterval(part)
+			if err != nil {
+				return
+			}
+			ret.AddInterval(sid, interval)
+		}
+	}
+	return
+}
+
+func parseGtidInterval(s string) (ret GtidInterval, err error) {
+	bounds := strings.SplitN(strings.TrimSpace(s), "-", 2)
+	ret.Start, err = strconv.ParseUint(bounds[0], 10, 64)
+	if err != nil {
+		return
+	}
+	ret.Stop = ret.Start + 1
+	if len(bounds) == 2 {
+		var last uint64
+		last, err = strconv.ParseUint(bounds[1], 10, 64)
+		if err != nil {
+			return
+		}
+		ret.Stop = last + 1
+	}
+	if ret.Start == 0 || ret.Stop <= ret.Start {
+		err = fmt.Errorf("not valid gtid interval: %s", s)
+	}
+	return
+}
+
+func (self GtidSet) sortedSids() []Sid {
+	sids := make([]Sid, 0, len(self))
+	for sid := range self {
+		sids = append(sids, sid)
+	}
+	sort.Slice(sids, func(i, j int) bool {
+		return sids[i].String() < sids[j].String()
+	})
+	return sids
+}
+
+func (self GtidSet) String() string {
+	parts := make([]string, 0, len(self))
+	for _, sid := range self.sortedSids() {
+		s := sid.String()
+		for _, interval := range self[sid] {
+			s += ":" + interval.String()
+		}
+		parts = append(parts, s)
+	}
+	return strings.Join(parts, ",")
+}
+
+func (self GtidSet) IsEmpty() bool {
+	return len(self) == 0
+}
+
+func (self GtidSet) Clone() GtidSet {
+	ret := make(GtidSet, len(self))
+	for sid, intervals := range self {
+		ret[sid] = append([]GtidInterval(nil), intervals...)
+	}
+	return ret
+}
+
+func (self GtidSet) Add(gtid Gtid) {
+	self.AddInterval(gtid.Sid, GtidInterval{Start: gtid.Gno, Stop: gtid.Gno + 1})
+}
+
+func (self GtidSet) AddInterval(sid Sid, interval GtidInterval) {
+	if interval.Stop <= interval.Start {
+		return
+	}
+	intervals := self[sid]
+	merged := make([]GtidInterval, 0, len(intervals)+1)
+	i := 0
+	for ; i < len(intervals) && intervals[i].Stop < interval.Start; i++ {
+		merged = append(merged, intervals[i])
+	}
+	for ; i < len(intervals) && intervals[i].Start <= interval.Stop; i++ {
+		if intervals[i].Start < interval.Start {
+			interval.Start = intervals[i].Start
+		}
+		if intervals[i].Stop > interval.Stop {
+			interval.Stop = intervals[i].Stop
+		}
+	}
+	merged = append(merged, interval)
+	merged = append(merged, intervals[i:]...)
+	self[sid] = merged
+}
+
+func (self GtidSet) ContainsGtid(gtid Gtid) bool {
+	for _, interval := range self[gtid.Sid] {
+		if gtid.Gno < interval.Start {
+			return false
+		}
+		if gtid.Gno < interval.Stop {
+			return true
+		}
+	}
+	return false
+}
+
+// whether all gtids of other are in self
+func (self GtidSet) Contains(other GtidSet) bool {
+	for sid, intervals := range other {
+		mine := self[sid]
+		i := 0
+		for _, interval := range intervals {
+			for i < len(mine) && mine[i].Stop < interval.Stop {
+				i++
+			}
+			if i >= len(mine) || mine[i].Start > interval.Start {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// add all gtids of other to self
+func (self GtidSet) Union(other GtidSet) {
+	for sid, intervals := range other {
+		for _, interval := range intervals {
+			self.AddInterval(sid, interval)
+		}
+	}
+}
+
+// remove all gtids of other from self
+func (self GtidSet) Subtract(other GtidSet) {
+	for sid, intervals := range other {
+		for _, interval := range intervals {
+			self.RemoveInterval(sid, interval)
+		}
+	}
+}
+
+func (self GtidSet) RemoveInterval(sid Sid, interval GtidInterval) {
+	intervals, ok := self[sid]
+	if !ok || interval.Stop <= interval.Start {
+		return
+	}
+	remained := make([]GtidInterval, 0, len(intervals)+1)
+	for _, mine := range intervals {
+		if mine.Stop <= interval.Start || mine.Start >= interval.Stop {
+			remained = append(remained, mine)
+			continue
+		}
+		if mine.Start < interval.Start {
+			remained = append(remained, GtidInterval{Start: mine.Start, Stop: interval.Start})
+		}
+		if mine.Stop > interval.Stop {
+			remained = append(remained, GtidInterval{Start: interval.Stop, Stop: mine.Stop})
+		}
+	}
+	if len(remained) == 0 {
+		delete(self, sid)
+	} else {
+		self[sid] = remained
+	}
+}
+
+func (self GtidSet) Equals(other GtidSet) bool {
+	return self.Contains(other) && other.Contains(self)
+}
+
+func (self GtidSet) EncodedLength() int {
+	n := 8
+	for _, intervals := range self {
+		n += 16 + 8 + len(intervals)*16
+	}
+	return n
+}
+
+func (self GtidSet) ToBuffer(buffer []byte) (writen int, err error) {
+	/*
+	   http://dev.mysql.com/doc/internals/en/com-binlog-dump-gtid.html
+	   8              n_sids
+	     for n_sids {
+	   16             SID
+	   8              n_intervals
+	       for n_intervals {
+	   8              start (inclusive)
+	   8              end (exclusive)
+	       }
+	     }
+	*/
+	if len(buffer) < self.EncodedLength() {
+		err = BUFFER_NOT_SUFFICIENT
+		return
+	}
+	ENDIAN.PutUint64(buffer, uint64(len(self)))
+	p := 8
+	for _, sid := range self.sortedSids() {
+		p += copy(buffer[p:], sid[:])
+		ENDIAN.PutUint64(buffer[p:], uint64(len(self[sid])))
+		p += 8
+		for _, interval := range self[sid] {
+			ENDIAN.PutUint64(buffer[p:], interval.Start)
+			ENDIAN.PutUint64(buffer[p+8:], interval.Stop)
+			p += 16
+		}
+	}
+	writen = p
+	return
+}
+
+func (self *GtidSet) FromBuffer(buffer []byte) (read int, err error) {
+	*self = NewGtidSet()
+	if len(buffer) < 8 {
+		err = BUFFER_NOT_SUFFICIENT
+		return
+	}
+	// counts come from the peer, compared by division so that crafted ones could not overflow
+	nSids := ENDIAN.Uint64(buffer)
+	p := 8
+	if nSids > uint64(len(buffer)-p)/24 {
+		err = BUFFER_NOT_SUFFICIENT
+		return
+	}
+	for i := uint64(0); i < nSids; i++ {
+		if len(buffer) < p+24 {
+			err = BUFFER_NOT_SUFFICIENT
+			return
+		}
+		var sid Sid
+		p += copy(sid[:], buffer[p:p+16])
+		nIntervals := ENDIAN.Uint64(buffer[p:])
+		p += 8
+		if nIntervals > uint64(len(buffer)-p)/16 {
+			err = BUFFER_NOT_SUFFICIENT
+			return
+		}
+		for j := uint64(0); j < nIntervals; j++ {
+			self.AddInterval(sid, GtidInterval{
+				Start: ENDIAN.Uint64(buffer[p:]),
+				Stop:  ENDIAN.Uint64(buffer[p+8:]),
+			})
+			p += 16
+		}
+	}
+	read = p
+	return
+}
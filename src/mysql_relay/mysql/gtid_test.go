@@ -0,0 +1,161 @@
+package mysql
+
+import (
+	"testing"
+)
+
+const (
+	testSid1 = "3e11fa47-71ca-11e1-9e33-c80aa9429562"
+	testSid2 = "2174b383-5441-11e8-b90a-c80aa9429562"
+)
+
+func mustParseGtidSet(t *testing.T, s string) GtidSet {
+	ret, err := ParseGtidSet(s)
+	if err != nil {
+		t.Fatalf("parse %s: %s", s, err.Error())
+	}
+	return ret
+}
+
+func TestParseGtidSet(t *testing.T) {
+	s := mustParseGtidSet(t, testSid1+":7:1-5:6,\n "+testSid2+":1-3:5")
+	expected := testSid2 + ":1-3:5," + testSid1 + ":1-7"
+	if s.String() != expected {
+		t.Errorf("%s != %s", s.String(), expected)
+	}
+	if !mustParseGtidSet(t, "").IsEmpty() {
+		t.Fail()
+	}
+	for _, bad := range []string{testSid1, testSid1 + ":0", testSid1 + ":5-3", "xxx:1-3"} {
+		if _, err := ParseGtidSet(bad); err == nil {
+			t.Errorf("%s should not be parsed", bad)
+		}
+	}
+}
+
+func TestGtidSetUnion(t *testing.T) {
+	s := mustParseGtidSet(t, testSid1+":1-5:10-20")
+	s.Union(mustParseGtidSet(t, testSid1+":6-9:30,"+testSid2+":1"))
+	expected := testSid2 + ":1," + testSid1 + ":1-20:30"
+	if s.String() != expected {
+		t.Errorf("%s != %s", s.String(), expected)
+	}
+	sid, _ := ParseSid(testSid1)
+	s.Add(Gtid{Sid: sid, Gno: 21})
+	expected = testSid2 + ":1," + testSid1 + ":1-21:30"
+	if s.String() != expected {
+		t.Errorf("%s != %s", s.String(), expected)
+	}
+}
+
+func TestGtidSetContains(t *testing.T) {
+	s := mustParseGtidSet(t, testSid1+":1-5:10-20,"+testSid2+":1-3")
+	if !s.Contains(mustParseGtidSet(t, testSid1+":2-4:10:20")) {
+		t.Fail()
+	}
+	if !s.Contains(NewGtidSet()) {
+		t.Fail()
+	}
+	if s.Contains(mustParseGtidSet(t, testSid1+":5-10")) {
+		t.Fail()
+	}
+	if s.Contains(mustParseGtidSet(t, testSid2+":4")) {
+		t.Fail()
+	}
+	sid, _ := ParseSid(testSid1)
+	if !s.ContainsGtid(Gtid{Sid: sid, Gno: 15}) || s.ContainsGtid(Gtid{Sid: sid, Gno: 7}) {
+		t.Fail()
+	}
+}
+
+func TestGtidSetSubtract(t *testing.T) {
+	s := mustParseGtidSet(t, testSid1+":1-20,"+testSid2+":1-3")
+	s.Subtract(mustParseGtidSet(t, testSid1+":5-7:20,"+testSid2+":1-5"))
+	expected := testSid1 + ":1-4:8-19"
+	if s.String() != expected {
+		t.Errorf("%s != %s", s.String(), expected)
+	}
+}
+
+func TestGtidSetEncode(t *testing.T) {
+	s := mustParseGtidSet(t, testSid1+":1-5:10-20,"+testSid2+":1-3")
+	var buffer [256]byte
+	n, err := s.ToBuffer(buffer[:])
+	if err != nil || n != s.EncodedLength() {
+		t.Fatalf("encoded %d bytes, %v", n, err)
+	}
+	var decoded GtidSet
+	_, err = decoded.FromBuffer(buffer[:n])
+	if err != nil || !decoded.Equals(s) {
+		t.Errorf("decoded: %s, %v", decoded.String(), err)
+	}
+	if _, err = s.ToBuffer(buffer[:n-1]); err != BUFFER_NOT_SUFFICIENT {
+		t.Fail()
+	}
+}
+
+func TestGtidSetDecodeCrafted(t *testing.T) {
+	s := mustParseGtidSet(t, testSid1+":1-5")
+	var buffer [256]byte
+	n, err := s.ToBuffer(buffer[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded GtidSet
+	// 1<<60 intervals of 16 bytes overflow to 0
+	ENDIAN.PutUint64(buffer[24:], 1<<60)
+	if _, err = decoded.FromBuffer(buffer[:n]); err != BUFFER_NOT_SUFFICIENT {
+		t.Errorf("intervals: %v", err)
+	}
+	ENDIAN.PutUint64(buffer[24:], 1)
+	ENDIAN.PutUint64(buffer[:], 1<<61)
+	if _, err = decoded.FromBuffer(buffer[:n]); err != BUFFER_NOT_SUFFICIENT {
+		t.Errorf("sids: %v", err)
+	}
+}
+
+func TestComBinlogDumpGtid(t *testing.T) {
+	dump := ComBinlogDumpGtid{
+		Flags:     BINLOG_THROUGH_GTID,
+		ServerId:  12,
+		BinlogPos: LOG_POS_START,
+		Gtids:     mustParseGtidSet(t, testSid1+":1-5"),
+	}
+	var buffer [256]byte
+	n, err := dump.ToBuffer(buffer[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded ComBinlogDumpGtid
+	_, err = decoded.FromBuffer(buffer[:n])
+	if err != nil || decoded.ServerId != 12 || decoded.BinlogPos != LOG_POS_START || !decoded.Gtids.Equals(dump.Gtids) {
+		t.Errorf("decoded: %v, %v", decoded, err)
+	}
+}
+
+func TestParseGtidEvent(t *testing.T) {
+	var buffer [128]byte
+	header := BinlogEventPacket{EventType: GTID_EVENT, EventSize: BinlogEventHeaderSize + 42 + 4}
+	header.ToBuffer(buffer[:])
+	p := BinlogEventHeaderSize + 1
+	buffer[p] = 1
+	sid, _ := ParseSid(testSid1)
+	copy(buffer[p+1:], sid[:])
+	ENDIAN.PutUint64(buffer[p+17:], 42)
+	buffer[p+25] = LOGICAL_TIMESTAMP_TYPECODE
+	ENDIAN.PutUint64(buffer[p+26:], 7)
+	ENDIAN.PutUint64(buffer[p+34:], 8)
+
+	event := header
+	event.PacketLength = header.EventSize + 1
+	event.BodyLength = int(header.EventSize) - BinlogEventHeaderSize
+	event.HasChecksum = true
+	var gtid GtidEvent
+	err := gtid.Parse(&event, buffer[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gtid.String() != testSid1+":42" || gtid.CommitFlag != 1 || gtid.LastCommitted != 7 || gtid.SequenceNumber != 8 {
+		t.Errorf("parsed: %v", gtid)
+	}
+}
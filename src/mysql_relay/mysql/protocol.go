@@ -7,6 +7,9 @@ import (
 	"io"
 )
 
+// payloads of this length or longer continue in the next packet
+const MAX_PACKET_LENGTH = 0xffffff
+
 type PacketHeader struct {
 	PacketSeq    byte
 	PacketLength uint32
@@ -89,22 +92,14 @@ func WritePacketTo(packet OutputPacket, writer io.Writer, buffer []byte) (err er
 func ReadPacket(header PacketHeader, reader io.Reader, buffer []byte) (err error) {
 	var bytesRead int
 	if int(header.PacketLength) <= len(buffer) {
-		bytesRead, err = reader.Read(buffer[0:int(header.PacketLength)])
-		if err != nil {
-			return
-		}
-		if int(header.PacketLength) != bytesRead {
+		bytesRead, err = io.ReadFull(reader, buffer[0:int(header.PacketLength)])
+		if err == io.ErrUnexpectedEOF || int(header.PacketLength) != bytesRead {
 			err = BYTES_READ_NOT_CORRECT
-			return
 		}
 	} else {
-		bytesRead, err = reader.Read(buffer)
-		if err != nil {
-			return
-		}
-		if len(buffer) != bytesRead {
+		bytesRead, err = io.ReadFull(reader, buffer)
+		if err == io.ErrUnexpectedEOF || len(buffer) != bytesRead {
 			err = BYTES_READ_NOT_CORRECT
-			return
 		}
 	}
 	return
@@ -406,10 +401,31 @@ func (self *PayloadPacket) GetReader(reader io.Reader, buffer []byte) PayloadRea
 	}
 }
 
+// the payload continues in the packet following a full one, header of the reader becomes that of the next
+func (self *PayloadReader) nextPacket() error {
+	header, err := ReadPacketHeader(self.reader)
+	if err != nil {
+		return err
+	}
+	if header.PacketSeq != self.header.PacketSeq+1 {
+		return PACKET_SEQ_NOT_CORRECT
+	}
+	self.header.PacketHeader = header
+	self.header.Pos = 0
+	self.firstBuffer = nil
+	return nil
+}
+
+// reads the payload to its end, which may span packets of MAX_PACKET_LENGTH
 func (self *PayloadReader) Read(buffer []byte) (n int, err error) {
-	if self.header.Pos >= int(self.header.PacketLength) {
-		//fmt.Printf("pr: eof! pos %d >= packetLength %d\n", self.header.Pos, self.header.PacketLength)
-		return 0, io.EOF
+	for self.header.Pos >= int(self.header.PacketLength) {
+		if self.header.PacketLength < MAX_PACKET_LENGTH {
+			//fmt.Printf("pr: eof! pos %d >= packetLength %d\n", self.header.Pos, self.header.PacketLength)
+			return 0, io.EOF
+		}
+		if err = self.nextPacket(); err != nil {
+			return 0, err
+		}
 	}
 	//fmt.Printf("pr: packet: size: %d pos: %d\n", self.header.PacketLength, self.header.Pos)
 	var copied int
@@ -450,6 +466,12 @@ func (self *PayloadReader) Read(buffer []byte) (n int, err error) {
 			self.header.Pos += copied
 		}
 		if self.header.Pos >= int(self.header.PacketLength) {
+			if self.header.PacketLength == MAX_PACKET_LENGTH {
+				if err = self.nextPacket(); err != nil {
+					return destEnd, err
+				}
+				continue
+			}
 			// reach the end
 			//fmt.Printf("pr: eof!\n")
 			return destEnd, io.EOF
@@ -458,6 +480,73 @@ func (self *PayloadReader) Read(buffer []byte) (n int, err error) {
 	return destEnd, nil
 }
 
+// writes a payload of known length as packets, splitting it at MAX_PACKET_LENGTH.
+// the header of each packet is written before its first byte, and an empty packet ends
+// a payload of a multiple of MAX_PACKET_LENGTH
+type PayloadWriter struct {
+	writer     io.Writer
+	seq        byte // of the next packet
+	remained   int  // bytes of payload not written
+	inPacket   int  // bytes of the current packet not written
+	lastLength int  // of the last packet begun
+}
+
+func NewPayloadWriter(writer io.Writer, length int, seq byte) *PayloadWriter {
+	return &PayloadWriter{writer: writer, seq: seq, remained: length}
+}
+
+// packets a payload of length is sent in
+func PacketCount(length int) int {
+	return length/MAX_PACKET_LENGTH + 1
+}
+
+func (self *PayloadWriter) writeHeader() (err error) {
+	length := self.remained
+	if length > MAX_PACKET_LENGTH {
+		length = MAX_PACKET_LENGTH
+	}
+	header := PacketHeader{PacketLength: uint32(length), PacketSeq: self.seq}
+	var buffer [4]byte
+	ENDIAN.PutUint32(buffer[:], header.ToUint32())
+	if _, err = self.writer.Write(buffer[:]); err != nil {
+		return
+	}
+	self.seq++
+	self.inPacket = length
+	self.lastLength = length
+	return
+}
+
+func (self *PayloadWriter) Write(buffer []byte) (n int, err error) {
+	if len(buffer) > self.remained {
+		return 0, BUFFER_NOT_SUFFICIENT
+	}
+	for len(buffer) > 0 {
+		if self.inPacket == 0 {
+			if err = self.writeHeader(); err != nil {
+				return
+			}
+		}
+		chunk := buffer
+		if len(chunk) > self.inPacket {
+			chunk = chunk[:self.inPacket]
+		}
+		var written int
+		written, err = self.writer.Write(chunk)
+		n += written
+		self.inPacket -= written
+		self.remained -= written
+		if err != nil {
+			return
+		}
+		buffer = buffer[written:]
+	}
+	if self.remained == 0 && self.inPacket == 0 && self.lastLength == MAX_PACKET_LENGTH {
+		err = self.writeHeader()
+	}
+	return
+}
+
 type ErrPacket struct {
 	PacketHeader
 	//http://dev.mysql.com/doc/internals/en/packet-ERR_Packet.html
@@ -466,15 +555,33 @@ type ErrPacket struct {
 	ErrorMessage string
 }
 
+// SQLSTATE of the error code, HY000 for those not listed as MySQL does
+func sqlStateOf(code uint16) string {
+	if state, ok := SERVER_SQL_STATES[code]; ok {
+		return state
+	}
+	return "HY000"
+}
+
 func BuildErrPacket(code uint16, params ...interface{}) (ret ErrPacket) {
 	ret = ErrPacket{
 		ErrorCode:    code,
-		SqlState:     SERVER_SQL_STATES[code],
+		SqlState:     sqlStateOf(code),
 		ErrorMessage: fmt.Sprintf(SERVER_ERR_MESSAGES[code], params...),
 	}
 	return
 }
 
+// for errors that carries its own message, such as ER_MASTER_FATAL_ERROR_READING_BINLOG sent by master
+func BuildErrPacketWithMessage(code uint16, message string) (ret ErrPacket) {
+	ret = ErrPacket{
+		ErrorCode:    code,
+		SqlState:     sqlStateOf(code),
+		ErrorMessage: message,
+	}
+	return
+}
+
 func (self *ErrPacket) FromBuffer(buffer []byte) (read int, err error) {
 	if buffer[0] != GRP_ERR {
 		err = NOT_ERR_PACKET
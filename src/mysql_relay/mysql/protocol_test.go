@@ -0,0 +1,89 @@
+package mysql
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+// payloads around the boundary of MAX_PACKET_LENGTH, written in chunks and read back
+func TestPayloadAtMaxPacketLength(t *testing.T) {
+	for _, length := range []int{MAX_PACKET_LENGTH - 1, MAX_PACKET_LENGTH, MAX_PACKET_LENGTH + 1, 2 * MAX_PACKET_LENGTH} {
+		payload := make([]byte, length)
+		for i := range payload {
+			payload[i] = byte(i * 7)
+		}
+		var stream bytes.Buffer
+		writer := NewPayloadWriter(&stream, length, 1)
+		for p := 0; p < length; p += 1 << 20 {
+			end := p + 1<<20
+			if end > length {
+				end = length
+			}
+			if _, err := writer.Write(payload[p:end]); err != nil {
+				t.Fatalf("%d: write: %v", length, err)
+			}
+		}
+
+		// headers of packets
+		packets := 0
+		for p := 0; p < stream.Len(); packets++ {
+			var header PacketHeader
+			header.FromUint32(ENDIAN.Uint32(stream.Bytes()[p:]))
+			if header.PacketSeq != byte(1+packets) {
+				t.Errorf("%d: packet %d seq %d", length, packets, header.PacketSeq)
+			}
+			p += 4 + int(header.PacketLength)
+		}
+		if packets != PacketCount(length) || stream.Len() != length+4*packets {
+			t.Errorf("%d: %d packets of %d bytes", length, packets, stream.Len())
+		}
+
+		var packet PayloadPacket
+		var buffer [1024]byte
+		header, err := ReadPacketHeader(&stream)
+		if err != nil {
+			t.Fatal(err)
+		}
+		packet.PacketHeader = header
+		if err = ReadPacket(header, &stream, buffer[:]); err != nil {
+			t.Fatal(err)
+		}
+		reader := packet.GetReader(&stream, buffer[:])
+		read, err := ioutil.ReadAll(&reader)
+		if err != nil || !bytes.Equal(read, payload) {
+			t.Errorf("%d: read %d bytes: %v", length, len(read), err)
+		}
+		if packet.PacketSeq != byte(packets) || stream.Len() != 0 {
+			t.Errorf("%d: last seq %d, %d bytes left", length, packet.PacketSeq, stream.Len())
+		}
+	}
+}
+
+func TestPayloadReaderSeq(t *testing.T) {
+	var stream bytes.Buffer
+	header := PacketHeader{PacketLength: MAX_PACKET_LENGTH, PacketSeq: 1}
+	var b [4]byte
+	ENDIAN.PutUint32(b[:], header.ToUint32())
+	stream.Write(b[:])
+	stream.Write(make([]byte, MAX_PACKET_LENGTH))
+	header = PacketHeader{PacketLength: 0, PacketSeq: 3}
+	ENDIAN.PutUint32(b[:], header.ToUint32())
+	stream.Write(b[:])
+
+	var packet PayloadPacket
+	packet.PacketHeader, _ = ReadPacketHeader(&stream)
+	reader := packet.GetReader(&stream, nil)
+	if _, err := ioutil.ReadAll(&reader); err != PACKET_SEQ_NOT_CORRECT {
+		t.Errorf("read with seq skipped: %v", err)
+	}
+}
+
+func TestErrPacketSqlState(t *testing.T) {
+	errPacket := BuildErrPacketWithMessage(ER_MASTER_FATAL_ERROR_READING_BINLOG, "Could not open log file")
+	var buffer [64]byte
+	n, _ := errPacket.ToBuffer(buffer[:])
+	if string(buffer[3:9]) != "#HY000" || string(buffer[9:n]) != errPacket.ErrorMessage {
+		t.Errorf("err packet: %q", buffer[:n])
+	}
+}
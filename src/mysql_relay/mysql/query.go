@@ -30,6 +30,14 @@ type ColumnCountPacket struct {
 }
 
 func (self *ColumnCountPacket) FromBuffer(buffer []byte) (read int, err error) {
+	if buffer[0] == GRP_ERR {
+		errPacket := ErrPacket{PacketHeader: self.PacketHeader}
+		read, err = errPacket.FromBuffer(buffer)
+		if err == nil {
+			err = errPacket.ToError()
+		}
+		return
+	}
 	var leInt LenencInt
 	read, err = leInt.FromBuffer(buffer)
 	self.ColumnCount = uint64(leInt)
@@ -276,6 +284,19 @@ func (self *ResultRowPacket) ToBuffer(buffer []byte) (writen int, err error) {
 	return
 }
 
+// bytes of the row encoded
+func (self *ResultRowPacket) Size() (size int) {
+	for i := range self.Values {
+		if self.Values[i].IsNull {
+			size++
+		} else {
+			n := LenencInt(len(self.Values[i].Value))
+			size += n.Size() + len(self.Values[i].Value)
+		}
+	}
+	return
+}
+
 type ResultSet struct {
 	Columns []ColumnDefinition
 	Rows    []ResultRow
@@ -286,6 +307,8 @@ type Cursor struct {
 	Columns    []ColumnDefinition
 	Rows       chan ResultRow
 	Buffer     []byte
+
+	written chan error // the error writing rows, sent once Rows is closed
 }
 
 func (self *Cursor) BeginRead() (err error) {
@@ -314,10 +337,14 @@ func (self *Cursor) BeginRead() (err error) {
 	go func() {
 		defer close(self.Rows)
 		for {
+			rowPacket.Init(len(self.Columns))
 			err := ReadPacketFrom(&rowPacket, self.ReadWriter, self.Buffer)
 			if err != nil || rowPacket.PacketLength == 0 {
 				return
 			}
+			if self.Buffer[0] == GRP_EOF && rowPacket.PacketLength < 9 {
+				return
+			}
 			self.Rows <- rowPacket.ResultRow
 		}
 	}()
@@ -351,28 +378,40 @@ func (self *Cursor) BeginWrite() (err error) {
 		return
 	}
 	self.Rows = make(chan ResultRow)
+	self.written = make(chan error, 1)
 	rowPacket := ResultRowPacket{}
 
 	go func() {
+		var err error
 		for row := range self.Rows {
+			if err != nil {
+				continue // drained after an error, so senders never block
+			}
 			seq++
 			rowPacket.PacketSeq = seq
 			rowPacket.ResultRow = row
-			err := WritePacketTo(&rowPacket, self.ReadWriter, self.Buffer)
-			if err != nil {
-				return
+			buffer := self.Buffer
+			if size := rowPacket.Size() + 4; size > len(buffer) {
+				buffer = make([]byte, size)
 			}
+			err = WritePacketTo(&rowPacket, self.ReadWriter, buffer)
 		}
-		seq++
-		eofPacket.PacketSeq = seq
-		err := WritePacketTo(&eofPacket, self.ReadWriter, self.Buffer)
-		if err != nil {
-			return
+		if err == nil {
+			seq++
+			eofPacket.PacketSeq = seq
+			err = WritePacketTo(&eofPacket, self.ReadWriter, self.Buffer)
 		}
+		self.written <- err
 	}()
 	return
 }
 
+// closes Rows after rows of BeginWrite are sent, returns the first error writing them and the EOF
+func (self *Cursor) EndWrite() error {
+	close(self.Rows)
+	return <-self.written
+}
+
 func (self *Cursor) ToRecordSet() (ret ResultSet, err error) {
 	ret.Columns = self.Columns
 	ret.Rows = make([]ResultRow, 0, 10)
@@ -0,0 +1,52 @@
+package mysql
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fails writes after limit bytes
+type limitedWriter struct {
+	bytes.Buffer
+	limit int
+}
+
+func (self *limitedWriter) Write(p []byte) (int, error) {
+	if self.Len()+len(p) > self.limit {
+		return 0, errors.New("connection closed")
+	}
+	return self.Buffer.Write(p)
+}
+
+func TestCursorWrite(t *testing.T) {
+	cols := []ColumnDefinition{{Catalog: "def", Name: "v", Type: MYSQL_TYPE_VAR_STRING}}
+	large := strings.Repeat("x", 4096)
+	for _, limit := range []int{1 << 20, 100} {
+		writer := &limitedWriter{limit: limit}
+		cursor := Cursor{Columns: cols, ReadWriter: writer, Buffer: make([]byte, 1024)}
+		if err := cursor.BeginWrite(); err != nil {
+			t.Fatal(err)
+		}
+		ended := make(chan error, 1)
+		go func() {
+			for i := 0; i < 3; i++ {
+				cursor.Rows <- ResultRow{Values: []Value{StringValue(large)}}
+			}
+			ended <- cursor.EndWrite()
+		}()
+		var err error
+		select {
+		case err = <-ended:
+		case <-time.After(time.Second):
+			t.Fatalf("limit %d: blocked writing rows", limit)
+		}
+		if limit < len(large) && err == nil {
+			t.Errorf("limit %d: write error not returned", limit)
+		} else if limit >= len(large) && err != nil {
+			t.Errorf("limit %d: %s", limit, err.Error())
+		}
+	}
+}
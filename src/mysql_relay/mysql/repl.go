@@ -103,6 +103,12 @@ const (
 	SEMISYNC_SKIP      = 2
 )
 
+// https://dev.mysql.com/doc/internals/en/semi-sync-binlog-event.html
+const (
+	SEMISYNC_INDICATOR byte = 0xef
+	SEMISYNC_FLAG_ACK  byte = 0x01
+)
+
 //https://dev.mysql.com/doc/internals/en/semi-sync-ack-packet.html
 //   payload:
 //     1                  [ef]
@@ -122,6 +128,21 @@ func (self *SemisyncAckPacket) ToBuffer(buffer []byte) (writen int, err error) {
 	return
 }
 
+func (self *SemisyncAckPacket) FromBuffer(buffer []byte) (read int, err error) {
+	if len(buffer) < 9 || int(self.PacketLength) > len(buffer) {
+		err = BUFFER_NOT_SUFFICIENT
+		return
+	}
+	if buffer[0] != SEMISYNC_INDICATOR {
+		err = fmt.Errorf("not a semisync ack packet")
+		return
+	}
+	self.Position = ENDIAN.Uint64(buffer[1:])
+	self.Name = string(buffer[9:self.PacketLength])
+	read = int(self.PacketLength)
+	return
+}
+
 func (self *BinlogEventPacket) String() string {
 	return fmt.Sprintf("type: %s, pos: %d, size: %d, timestamp: %d",
 		EventNames[self.EventType], self.LogPos, self.EventSize, self.Timestamp)
@@ -172,13 +193,29 @@ func (self *BinlogEventPacket) FromBuffer(buffer []byte) (read int, err error) {
 
 func (self *BinlogEventPacket) ToBuffer(buffer []byte) (writen int, err error) {
 	buffer[0] = '\x00'
-	ENDIAN.PutUint32(buffer[1:], self.Timestamp)
-	buffer[5] = self.EventType
-	ENDIAN.PutUint32(buffer[6:], self.ServerId)
-	ENDIAN.PutUint32(buffer[10:], self.EventSize)
-	ENDIAN.PutUint32(buffer[14:], self.LogPos)
-	ENDIAN.PutUint16(buffer[18:], self.Flags)
-	writen = BinlogEventHeaderSize + 1
+	p := 1
+	if self.Semisync != SEMISYNC_NO {
+		buffer[1] = SEMISYNC_INDICATOR
+		buffer[2] = 0
+		if self.Semisync == SEMISYNC_ACK {
+			buffer[2] = SEMISYNC_FLAG_ACK
+		}
+		p = 3
+	}
+	writen, err = self.HeaderToBuffer(buffer[p:])
+	writen += p
+	return
+}
+
+// write the event header only, without the leading ok byte
+func (self *BinlogEventPacket) HeaderToBuffer(buffer []byte) (writen int, err error) {
+	ENDIAN.PutUint32(buffer[0:], self.Timestamp)
+	buffer[4] = self.EventType
+	ENDIAN.PutUint32(buffer[5:], self.ServerId)
+	ENDIAN.PutUint32(buffer[9:], self.EventSize)
+	ENDIAN.PutUint32(buffer[13:], self.LogPos)
+	ENDIAN.PutUint16(buffer[17:], self.Flags)
+	writen = BinlogEventHeaderSize
 	return
 }
 
@@ -186,6 +223,12 @@ func (self *BinlogEventPacket) IsFake() bool {
 	return self.LogPos == 0
 }
 
+// ChecksumAlgorism of FormatDescriptionEvent
+const (
+	BINLOG_CHECKSUM_ALG_OFF   = 0
+	BINLOG_CHECKSUM_ALG_CRC32 = 1
+)
+
 type FormatDescriptionEvent struct {
 	BinlogVersion         uint16
 	MysqlServerVersion    string
@@ -223,6 +266,23 @@ type TableMapEvent struct {
 	Columns    []TableMapColumnEntry
 }
 
+const LOGICAL_TIMESTAMP_TYPECODE = 2
+
+type GtidEvent struct {
+	CommitFlag byte
+	Gtid
+	// since 5.7
+	LastCommitted  int64
+	SequenceNumber int64
+	// since 8.0, in microseconds
+	ImmediateCommitTimestamp uint64
+	OriginalCommitTimestamp  uint64
+}
+
+type PreviousGtidsEvent struct {
+	Gtids GtidSet
+}
+
 type RotateEventPacket struct {
 	BinlogEventPacket
 	RotateEvent
@@ -243,13 +303,13 @@ func (self *RotateEvent) Parse(packet *BinlogEventPacket, buffer []byte) (err er
 	return
 }
 
-func (self *RotateEvent) BuildFakePacket(serverId uint32) RotateEventPacket {
+func (self *RotateEvent) BuildFakePacket(serverId uint32, checksum bool) RotateEventPacket {
 	var ret RotateEventPacket
 	ret.LogPos = 0
 	ret.ServerId = serverId
 	ret.EventSize = uint32(len(self.Name)+8) + BinlogEventHeaderSize
 	ret.EventType = ROTATE_EVENT
-	ret.HasChecksum = true
+	ret.HasChecksum = checksum
 	ret.Flags = LOG_EVENT_ARTIFICIAL_F
 	if ret.HasChecksum {
 		ret.EventSize += 4
@@ -269,7 +329,7 @@ func (self *RotateEventPacket) ToBuffer(buffer []byte) (writen int, err error) {
 	writen, err = self.RotateEvent.ToBuffer(buffer[n:])
 	writen += n
 	if self.HasChecksum {
-		checksum := crc32.ChecksumIEEE(buffer[1:writen])
+		checksum := crc32.ChecksumIEEE(buffer[n-BinlogEventHeaderSize : writen])
 		//fmt.Printf("crc32 of %v == %08x\n", buffer[1:writen], checksum)
 		ENDIAN.PutUint32(buffer[writen:], checksum)
 		writen += 4
@@ -284,6 +344,142 @@ func (self *RotateEvent) ToBuffer(buffer []byte) (writen int, err error) {
 	return
 }
 
+// sent by master while it has no event to send, the body is the name of the binlog at LogPos
+type HeartbeatEvent struct {
+	Name string
+}
+
+type HeartbeatEventPacket struct {
+	BinlogEventPacket
+	HeartbeatEvent
+}
+
+func (self *HeartbeatEvent) BuildPacket(serverId uint32, pos uint32, checksum bool) HeartbeatEventPacket {
+	var ret HeartbeatEventPacket
+	ret.LogPos = pos
+	ret.ServerId = serverId
+	ret.EventSize = uint32(len(self.Name)) + BinlogEventHeaderSize
+	ret.EventType = HEARTBEAT_EVENT
+	ret.HasChecksum = checksum
+	ret.Flags = LOG_EVENT_ARTIFICIAL_F
+	if ret.HasChecksum {
+		ret.EventSize += 4
+	}
+	ret.HeartbeatEvent = *self
+	return ret
+}
+
+func (self *HeartbeatEventPacket) ToBuffer(buffer []byte) (writen int, err error) {
+	writen, err = self.BinlogEventPacket.ToBuffer(buffer)
+	if err != nil {
+		return
+	}
+	n := writen
+	writen += copy(buffer[writen:], []byte(self.Name))
+	if self.HasChecksum {
+		ENDIAN.PutUint32(buffer[writen:], crc32.ChecksumIEEE(buffer[n-BinlogEventHeaderSize:writen]))
+		writen += 4
+	}
+	return
+}
+
+func (self *HeartbeatEvent) Parse(packet *BinlogEventPacket, buffer []byte) (err error) {
+	if packet.EventType != HEARTBEAT_EVENT {
+		err = NOT_SUCH_EVENT
+		return
+	}
+	p := int(packet.PacketLength) - packet.BodyLength
+	self.Name = string(buffer[p:eventBodyEnd(packet, buffer)])
+	return
+}
+
+func eventBodyEnd(packet *BinlogEventPacket, buffer []byte) int {
+	end := int(packet.PacketLength)
+	if packet.HasChecksum {
+		end -= 4
+	}
+	if end > len(buffer) {
+		end = len(buffer)
+	}
+	return end
+}
+
+func (self *GtidEvent) Parse(packet *BinlogEventPacket, buffer []byte) (err error) {
+	/*
+	   also for ANONYMOUS_GTID_EVENT
+	   1              commit flag
+	   16             SID
+	   8              GNO
+	     since 5.7 {
+	   1              logical timestamp typecode
+	   8              last committed
+	   8              sequence number
+	     }
+	     since 8.0 {
+	   7              immediate commit timestamp, highest bit set if original commit timestamp follows
+	   7              original commit timestamp
+	     }
+	*/
+	if packet.EventType != GTID_EVENT && packet.EventType != ANONYMOUS_GTID_EVENT {
+		err = NOT_SUCH_EVENT
+		return
+	}
+	p := int(packet.PacketLength) - packet.BodyLength
+	end := eventBodyEnd(packet, buffer)
+	if end < p+25 {
+		err = BUFFER_NOT_SUFFICIENT
+		return
+	}
+	self.CommitFlag = buffer[p]
+	copy(self.Sid[:], buffer[p+1:p+17])
+	self.Gno = ENDIAN.Uint64(buffer[p+17:])
+	p += 25
+	if end < p+17 || buffer[p] != LOGICAL_TIMESTAMP_TYPECODE {
+		return
+	}
+	self.LastCommitted = int64(ENDIAN.Uint64(buffer[p+1:]))
+	self.SequenceNumber = int64(ENDIAN.Uint64(buffer[p+9:]))
+	p += 17
+	if end < p+7 {
+		return
+	}
+	self.ImmediateCommitTimestamp = readUint56(buffer[p:])
+	self.OriginalCommitTimestamp = self.ImmediateCommitTimestamp
+	p += 7
+	if self.ImmediateCommitTimestamp&(1<<55) != 0 {
+		self.ImmediateCommitTimestamp &^= 1 << 55
+		if end < p+7 {
+			err = BUFFER_NOT_SUFFICIENT
+			return
+		}
+		self.OriginalCommitTimestamp = readUint56(buffer[p:])
+	}
+	return
+}
+
+func readUint56(buffer []byte) uint64 {
+	return uint64(ENDIAN.Uint32(buffer)) | uint64(ENDIAN.Uint16(buffer[4:]))<<32 | uint64(buffer[6])<<48
+}
+
+func (self *PreviousGtidsEvent) Parse(packet *BinlogEventPacket, buffer []byte) (err error) {
+	if packet.EventType != PREVIOUS_GTIDS_EVENT {
+		err = NOT_SUCH_EVENT
+		return
+	}
+	p := int(packet.PacketLength) - packet.BodyLength
+	end := eventBodyEnd(packet, buffer)
+	if end < p {
+		err = BUFFER_NOT_SUFFICIENT
+		return
+	}
+	_, err = self.Gtids.FromBuffer(buffer[p:end])
+	return
+}
+
+func (self *PreviousGtidsEvent) ToBuffer(buffer []byte) (writen int, err error) {
+	return self.Gtids.ToBuffer(buffer)
+}
+
 func (self *FormatDescriptionEvent) Parse(packet *BinlogEventPacket, buffer []byte) (err error) {
 	/*
 	   http://dev.mysql.com/doc/internals/en/format-description-event.html
@@ -384,8 +580,16 @@ func readEventPacketHeader(readWriter io.ReadWriter, buffer []byte, expectedSeq
 	return
 }
 
-func (self *Client) DumpBinlog(cmdBinlogDump ComBinglogDump, semisync bool, heartbeatPeriod uint32) (ret *BinlogEventStream, err error) {
+func (self *Client) DumpBinlog(cmdBinlogDump ComBinglogDump, semisync bool, heartbeatPeriod uint64) (ret *BinlogEventStream, err error) {
 	//fmt.Printf("DumpBinlog %v!!! ...", cmdBinlogDump)
+	return self.dump(&cmdBinlogDump, semisync, heartbeatPeriod)
+}
+
+func (self *Client) DumpBinlogGtid(cmdBinlogDumpGtid ComBinlogDumpGtid, semisync bool, heartbeatPeriod uint64) (ret *BinlogEventStream, err error) {
+	return self.dump(&cmdBinlogDumpGtid, semisync, heartbeatPeriod)
+}
+
+func (self *Client) dump(cmdDump Command, semisync bool, heartbeatPeriod uint64) (ret *BinlogEventStream, err error) {
 	defer util.RecoverToError(&err)
 	ret = new(BinlogEventStream)
 	ret.ret = make(chan *BinlogEventPacket)
@@ -395,14 +599,18 @@ func (self *Client) DumpBinlog(cmdBinlogDump ComBinglogDump, semisync bool, hear
 			close(ret.ret)
 		}
 	}()
-	_ = util.Assert1(self.Command(&QueryCommand{Query: "SET @master_binlog_checksum='NONE';"}))
+	checksum := self.MasterBinlogChecksum
+	if checksum == "" {
+		checksum = "NONE"
+	}
+	_ = util.Assert1(self.Command(&QueryCommand{Query: fmt.Sprintf("SET @master_binlog_checksum='%s';", checksum)}))
 	_ = util.Assert1(self.Command(&QueryCommand{Query: fmt.Sprintf("SET @master_heartbeat_period=%d;", heartbeatPeriod)}))
 	if semisync {
 		_, semi_err := self.Command(&QueryCommand{Query: "SET @rpl_semi_sync_slave = 1;"})
 		ret.semisync = (semi_err == nil)
 	}
 
-	cmdPacket := CommandPacket{Command: &cmdBinlogDump}
+	cmdPacket := CommandPacket{Command: cmdDump}
 	util.Assert0(WritePacketTo(&cmdPacket, self.Conn, self.Buffer[:]))
 
 	go func() {
@@ -433,6 +641,7 @@ func (self *Client) DumpBinlog(cmdBinlogDump ComBinglogDump, semisync bool, hear
 			<-ret.canRead
 			packetReader := event.GetReader(self.Conn, self.Buffer[:])
 			io.Copy(ioutil.Discard, &packetReader)
+			seq = event.PacketSeq // of the last packet of an event in many
 		}
 	}()
 	return
@@ -0,0 +1,62 @@
+package mysql
+
+import (
+	"hash/crc32"
+	"testing"
+)
+
+func TestSemisyncAckPacket(t *testing.T) {
+	ack := SemisyncAckPacket{Name: "mysql-bin.000003", Position: 1234}
+	var buffer [64]byte
+	n, err := ack.ToBuffer(buffer[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded SemisyncAckPacket
+	decoded.PacketLength = uint32(n)
+	_, err = decoded.FromBuffer(buffer[:])
+	if err != nil || decoded.Name != ack.Name || decoded.Position != ack.Position {
+		t.Errorf("decoded: %v, %v", decoded, err)
+	}
+}
+
+func TestSemisyncEventHeader(t *testing.T) {
+	event := BinlogEventPacket{EventType: XID_EVENT, EventSize: 31, LogPos: 100, Semisync: SEMISYNC_ACK}
+	var buffer [32]byte
+	n, _ := event.ToBuffer(buffer[:])
+	if n != BinlogEventHeaderSize+3 || buffer[1] != SEMISYNC_INDICATOR || buffer[2] != SEMISYNC_FLAG_ACK {
+		t.Fatalf("semisync header: %v", buffer[:3])
+	}
+	var decoded BinlogEventPacket
+	decoded.Semisync = SEMISYNC_ACK
+	decoded.FromBuffer(buffer[:])
+	if decoded.EventType != XID_EVENT || decoded.LogPos != 100 {
+		t.Errorf("decoded: %v", decoded)
+	}
+}
+
+func TestHeartbeatEventPacket(t *testing.T) {
+	heartbeat := HeartbeatEvent{Name: "mysql-bin.000003"}
+	packet := heartbeat.BuildPacket(1001, 4567, true)
+	packet.Semisync = SEMISYNC_SKIP
+	var buffer [64]byte
+	n, err := packet.ToBuffer(buffer[:])
+	if err != nil || n != 3+int(packet.EventSize) {
+		t.Fatalf("written %d: %v", n, err)
+	}
+	if crc32.ChecksumIEEE(buffer[3:n-4]) != ENDIAN.Uint32(buffer[n-4:]) {
+		t.Error("bad checksum")
+	}
+	var event BinlogEventPacket
+	event.Semisync = SEMISYNC_SKIP
+	event.PacketLength = uint32(n)
+	event.FromBuffer(buffer[:])
+	event.HasChecksum = true
+	var decoded HeartbeatEvent
+	if err = decoded.Parse(&event, buffer[:n]); err != nil || decoded != heartbeat {
+		t.Errorf("decoded: %v, %v", decoded, err)
+	}
+	if event.EventType != HEARTBEAT_EVENT || event.LogPos != 4567 || event.ServerId != 1001 {
+		t.Errorf("header: %s", event.String())
+	}
+}
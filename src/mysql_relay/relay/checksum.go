@@ -0,0 +1,81 @@
+package relay
+
+import (
+	"errors"
+	"hash/crc32"
+	"mysql_relay/mysql"
+)
+
+var CHECKSUM_MISMATCH = errors.New("event checksum mismatch")
+
+// policies on checksum mismatch
+const (
+	CHECKSUM_ERROR_RECONNECT = "reconnect" // discard the event and dump again from the last good position
+	CHECKSUM_ERROR_STOP      = "stop"      // stop dumping the upstream, the relay still serves replicas
+)
+
+// verifies the crc32 of an event chunk by chunk.
+// the event may be modified before written, the checksum written is then recomputed
+type eventChecksum struct {
+	enabled  bool
+	size     uint32
+	offset   uint32
+	received uint32
+	written  uint32
+	expected [4]byte
+}
+
+// begin with the first chunk of an event
+func (self *eventChecksum) Begin(chunk []byte, enabled bool) {
+	*self = eventChecksum{enabled: enabled}
+	if enabled {
+		self.size = mysql.ENDIAN.Uint32(chunk[9:])
+	}
+}
+
+// a chunk as received, must be called before Written of the same chunk
+func (self *eventChecksum) Received(chunk []byte) {
+	if !self.enabled {
+		return
+	}
+	payload, trailer := self.split(chunk)
+	self.received = crc32.Update(self.received, crc32.IEEETable, chunk[:payload])
+	for i := payload; i < trailer; i++ {
+		self.expected[self.offset+uint32(i)-(self.size-4)] = chunk[i]
+	}
+}
+
+// the chunk to be written, the checksum in it is replaced.
+// returns CHECKSUM_MISMATCH at the end of the event if checksum received is not correct
+func (self *eventChecksum) Written(chunk []byte) error {
+	if !self.enabled {
+		return nil
+	}
+	payload, trailer := self.split(chunk)
+	self.written = crc32.Update(self.written, crc32.IEEETable, chunk[:payload])
+	var sum [4]byte
+	mysql.ENDIAN.PutUint32(sum[:], self.written)
+	for i := payload; i < trailer; i++ {
+		chunk[i] = sum[self.offset+uint32(i)-(self.size-4)]
+	}
+	self.offset += uint32(len(chunk))
+	if self.offset >= self.size && mysql.ENDIAN.Uint32(self.expected[:]) != self.received {
+		return CHECKSUM_MISMATCH
+	}
+	return nil
+}
+
+// chunk[:payload] is checksummed, chunk[payload:trailer] is part of the checksum
+func (self *eventChecksum) split(chunk []byte) (payload int, trailer int) {
+	payload, trailer = len(chunk), len(chunk)
+	if self.offset+uint32(len(chunk)) > self.size-4 {
+		payload = 0
+		if self.offset < self.size-4 {
+			payload = int(self.size - 4 - self.offset)
+		}
+	}
+	if self.offset+uint32(len(chunk)) > self.size {
+		trailer = int(self.size - self.offset)
+	}
+	return
+}
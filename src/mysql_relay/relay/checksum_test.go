@@ -0,0 +1,97 @@
+package relay
+
+import (
+	"hash/crc32"
+	"io/ioutil"
+	"mysql_relay/mysql"
+	"os"
+	"strings"
+	"testing"
+)
+
+func buildTestEvent(size int) []byte {
+	event := make([]byte, size)
+	for i := range event {
+		event[i] = byte(i)
+	}
+	mysql.ENDIAN.PutUint32(event[9:], uint32(size))
+	mysql.ENDIAN.PutUint32(event[size-4:], crc32.ChecksumIEEE(event[:size-4]))
+	return event
+}
+
+func feedChunks(event []byte, chunkSize int, rewrite func([]byte)) error {
+	var checksum eventChecksum
+	for p := 0; p < len(event); p += chunkSize {
+		end := p + chunkSize
+		if end > len(event) {
+			end = len(event)
+		}
+		chunk := event[p:end]
+		if p == 0 {
+			checksum.Begin(chunk, true)
+		}
+		checksum.Received(chunk)
+		if p == 0 && rewrite != nil {
+			rewrite(chunk)
+		}
+		if err := checksum.Written(chunk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestEventChecksum(t *testing.T) {
+	for _, chunkSize := range []int{19, 21, 100, 1000} {
+		event := buildTestEvent(102)
+		if err := feedChunks(event, chunkSize, nil); err != nil {
+			t.Errorf("chunk %d: %s", chunkSize, err.Error())
+		}
+
+		event = buildTestEvent(102)
+		event[50]++
+		if err := feedChunks(event, chunkSize, nil); err != CHECKSUM_MISMATCH {
+			t.Errorf("chunk %d: corruption not detected", chunkSize)
+		}
+
+		event = buildTestEvent(102)
+		if err := feedChunks(event, chunkSize, func(header []byte) { rewriteLogPos(header, 1000) }); err != nil {
+			t.Errorf("chunk %d: %s", chunkSize, err.Error())
+		}
+		if mysql.ENDIAN.Uint32(event[98:]) != crc32.ChecksumIEEE(event[:98]) {
+			t.Errorf("chunk %d: checksum not rewritten", chunkSize)
+		}
+
+		event = buildTestEvent(102)
+		if err := feedChunks(event, chunkSize, func(header []byte) { rewriteServerId(header, 3306) }); err != nil {
+			t.Errorf("chunk %d: %s", chunkSize, err.Error())
+		}
+		if mysql.ENDIAN.Uint32(event[5:]) != 3306 {
+			t.Errorf("chunk %d: server_id not rewritten", chunkSize)
+		}
+		if mysql.ENDIAN.Uint32(event[98:]) != crc32.ChecksumIEEE(event[:98]) {
+			t.Errorf("chunk %d: checksum not rewritten with server_id", chunkSize)
+		}
+	}
+}
+
+func TestChecksumErrorStop(t *testing.T) {
+	f, err := ioutil.TempFile("", "relay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	f.Write(buildTestBinlog(2))
+	relay := BinlogRelay{name: "u1", checksumErrorPolicy: CHECKSUM_ERROR_STOP}
+	err = relay.onChecksumError(f, "log-bin.000001", 100)
+	if err == nil || !strings.Contains(err.Error(), "log-bin.000001:100, upstream stopped") {
+		t.Errorf("error %v", err)
+	}
+	if !relay.Stopped() {
+		t.Error("upstream not stopped")
+	}
+	if stat, _ := f.Stat(); stat.Size() != 100 {
+		t.Errorf("truncated to %d", stat.Size())
+	}
+}
@@ -0,0 +1,407 @@
+package relay
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mysql_relay/mysql"
+	"mysql_relay/util"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+every relayed binlog has a sidecar index named <binlog>.idx, one record per line:
+
+	P <gtids>                   PREVIOUS_GTIDS of the binlog
+	E <index> <pos>             position of every EVENT_POS_INTERVAL-th event
+	G <index> <pos> <gtids>     a GTID_EVENT at pos, gtids are those before it
+	S <index> <pos> [<gtids>]   state at pos, written when the binlog is closed
+
+records are appended by writer without sync, the tail of binlog not covered is rescanned on load
+*/
+const (
+	BINLOG_INDEX_SUFFIX = ".idx"
+	EVENT_POS_INTERVAL  = 256
+	GTID_POS_INTERVAL   = 1 << 20 // bytes between two gtid checkpoints
+)
+
+type BinlogIndexEventPosEntry struct {
+	Index uint32
+	Pos   uint32
+}
+
+// gtids executed before the GTID_EVENT at Pos, including PREVIOUS_GTIDS of the binlog
+type BinlogIndexGtidPosEntry struct {
+	Index uint32
+	Pos   uint32
+	Gtids mysql.GtidSet
+}
+
+type BinlogIndexEntry struct {
+	Name          string
+	Size          uint32
+	Count         uint32
+	EventPos      []BinlogIndexEventPosEntry
+	PreviousGtids mysql.GtidSet // nil if the binlog has no PREVIOUS_GTIDS_EVENT
+	GtidPos       []BinlogIndexGtidPosEntry
+
+	loaded bool
+	gtids  mysql.GtidSet // gtids till Size, only touched by the writer of the binlog
+	purged bool          // removed, kept so indexes of binlogs stay the same
+}
+
+// append an event at Size, returns records for the sidecar
+func (self *BinlogIndexEntry) Append(size uint32, eventType byte, gtid mysql.Gtid, previousGtids mysql.GtidSet) (records []string) {
+	if self.Count%EVENT_POS_INTERVAL == 0 {
+		entry := BinlogIndexEventPosEntry{Index: self.Count, Pos: self.Size}
+		self.EventPos = append(self.EventPos, entry)
+		records = append(records, fmt.Sprintf("E %d %d", entry.Index, entry.Pos))
+	}
+	switch eventType {
+	case mysql.PREVIOUS_GTIDS_EVENT:
+		if previousGtids != nil {
+			self.PreviousGtids = previousGtids.Clone()
+			self.gtids = previousGtids.Clone()
+			records = append(records, "P "+previousGtids.String())
+		}
+	case mysql.GTID_EVENT:
+		if self.gtids == nil {
+			break // gtids before are unknown
+		}
+		last := uint32(mysql.LOG_POS_START)
+		if len(self.GtidPos) > 0 {
+			last = self.GtidPos[len(self.GtidPos)-1].Pos
+		}
+		if self.Size-last >= GTID_POS_INTERVAL {
+			entry := BinlogIndexGtidPosEntry{Index: self.Count, Pos: self.Size, Gtids: self.gtids.Clone()}
+			self.GtidPos = append(self.GtidPos, entry)
+			records = append(records, fmt.Sprintf("G %d %d %s", entry.Index, entry.Pos, entry.Gtids.String()))
+		}
+		self.gtids.Add(gtid)
+	}
+	self.Count++
+	self.Size += size
+	return
+}
+
+func (self *BinlogIndexEntry) stateRecord() string {
+	if self.gtids == nil {
+		return fmt.Sprintf("S %d %d", self.Count, self.Size)
+	}
+	return fmt.Sprintf("S %d %d %s", self.Count, self.Size, self.gtids.String())
+}
+
+// all records of the index, ends with the state
+func (self *BinlogIndexEntry) records() (records []string) {
+	if self.PreviousGtids != nil {
+		records = append(records, "P "+self.PreviousGtids.String())
+	}
+	i := 0
+	for _, entry := range self.EventPos {
+		for ; i < len(self.GtidPos) && self.GtidPos[i].Pos < entry.Pos; i++ {
+			records = append(records, fmt.Sprintf("G %d %d %s", self.GtidPos[i].Index, self.GtidPos[i].Pos, self.GtidPos[i].Gtids.String()))
+		}
+		records = append(records, fmt.Sprintf("E %d %d", entry.Index, entry.Pos))
+	}
+	for ; i < len(self.GtidPos); i++ {
+		records = append(records, fmt.Sprintf("G %d %d %s", self.GtidPos[i].Index, self.GtidPos[i].Pos, self.GtidPos[i].Gtids.String()))
+	}
+	records = append(records, self.stateRecord())
+	return
+}
+
+// parse a record, the index is set to the state of G and S records
+func (self *BinlogIndexEntry) loadRecord(record string) (err error) {
+	fields := strings.SplitN(record, " ", 4)
+	var index, pos uint64
+	if len(fields) >= 3 {
+		index, err = strconv.ParseUint(fields[1], 10, 32)
+		if err == nil {
+			pos, err = strconv.ParseUint(fields[2], 10, 32)
+		}
+		if err != nil {
+			return
+		}
+	}
+	var gtids mysql.GtidSet
+	switch {
+	case fields[0] == "P" && len(fields) == 2:
+		gtids, err = mysql.ParseGtidSet(fields[1])
+		if err != nil {
+			return
+		}
+		self.PreviousGtids = gtids
+		self.gtids = gtids.Clone()
+
+	case fields[0] == "E" && len(fields) == 3:
+		self.EventPos = append(self.EventPos, BinlogIndexEventPosEntry{Index: uint32(index), Pos: uint32(pos)})
+
+	case fields[0] == "G" && len(fields) == 4:
+		gtids, err = mysql.ParseGtidSet(fields[3])
+		if err != nil {
+			return
+		}
+		self.GtidPos = append(self.GtidPos, BinlogIndexGtidPosEntry{Index: uint32(index), Pos: uint32(pos), Gtids: gtids})
+		self.Count, self.Size, self.gtids = uint32(index), uint32(pos), gtids.Clone()
+
+	case fields[0] == "S" && len(fields) >= 3:
+		self.gtids = nil
+		if len(fields) == 4 {
+			self.gtids, err = mysql.ParseGtidSet(fields[3])
+			if err != nil {
+				return
+			}
+		}
+		self.Count, self.Size = uint32(index), uint32(pos)
+
+	default:
+		err = fmt.Errorf("bad index record: %s", record)
+	}
+	return
+}
+
+// the last checkpoint of which the gtids are all in gtids
+func (self *BinlogIndexEntry) GtidStart(gtids mysql.GtidSet) uint32 {
+	pos := uint32(mysql.LOG_POS_START)
+	for _, entry := range self.GtidPos {
+		if !gtids.Contains(entry.Gtids) {
+			break
+		}
+		pos = entry.Pos
+	}
+	return pos
+}
+
+func (self *BinlogRelay) indexPath(name string) string {
+	return self.NameToPath(name) + BINLOG_INDEX_SUFFIX
+}
+
+// load the sidecar index of a binlog and scan events not indexed yet
+func (self *BinlogRelay) loadBinlogIndex(entry *BinlogIndexEntry) (err error) {
+	name := entry.Name
+	*entry = BinlogIndexEntry{Name: name, Size: mysql.LOG_POS_START}
+	path := self.indexPath(name)
+	data, err := ioutil.ReadFile(path)
+	missing := os.IsNotExist(err)
+	if err == nil {
+		records := strings.Split(string(data), "\n")
+		// the last one is empty, or torn
+		for _, record := range records[:len(records)-1] {
+			if err = entry.loadRecord(record); err != nil {
+				self.logger.Warn("load index %s: %s", path, err.Error())
+				break
+			}
+		}
+	} else if !missing {
+		self.logger.Warn("load index %s: %s", path, err.Error())
+	}
+	var stat os.FileInfo
+	stat, err = os.Stat(self.NameToPath(name))
+	if err != nil {
+		return
+	}
+	if int64(entry.Size) > stat.Size() {
+		// binlog is synced before index, may be lost after a crash
+		self.logger.Warn("index of %s beyond %d, rebuild", name, stat.Size())
+		*entry = BinlogIndexEntry{Name: name, Size: mysql.LOG_POS_START}
+	}
+	// records after the state are rebuilt by scanning
+	for len(entry.EventPos) > 0 && entry.EventPos[len(entry.EventPos)-1].Index >= entry.Count {
+		entry.EventPos = entry.EventPos[:len(entry.EventPos)-1]
+	}
+	if len(entry.GtidPos) > 0 && entry.GtidPos[len(entry.GtidPos)-1].Pos == entry.Size {
+		entry.GtidPos = entry.GtidPos[:len(entry.GtidPos)-1]
+	}
+
+	indexed := entry.Size
+	err = self.scanBinlog(entry)
+	if err != nil {
+		return
+	}
+	entry.loaded = true
+	if entry.Size != indexed || missing {
+		self.logger.Info("indexed %s from %d to %d", entry.Name, indexed, entry.Size)
+		err = self.saveBinlogIndex(entry)
+	}
+	return
+}
+
+func (self *BinlogRelay) scanBinlog(entry *BinlogIndexEntry) (err error) {
+	reader, err := OpenBinlogReader(self.NameToPath(entry.Name))
+	if err != nil {
+		return
+	}
+	defer reader.Close()
+	if entry.Size >= reader.Size() {
+		return
+	}
+	err = reader.Seek(entry.Size)
+	if err != nil {
+		return
+	}
+	for {
+		var event mysql.BinlogEventPacket
+		event, err = reader.Next()
+		if err == io.EOF {
+			err = nil
+			return
+		} else if err == INCOMPLETE_EVENT {
+			self.logger.Warn("incomplete event at %s:%d", entry.Name, reader.Pos)
+			err = nil
+			return
+		} else if err != nil {
+			return
+		}
+		var gtid mysql.Gtid
+		var previousGtids mysql.GtidSet
+		switch event.EventType {
+		case mysql.GTID_EVENT:
+			var gtidEvent mysql.GtidEvent
+			err = gtidEvent.Parse(&event, reader.Buffer)
+			if err != nil {
+				return
+			}
+			gtid = gtidEvent.Gtid
+		case mysql.PREVIOUS_GTIDS_EVENT:
+			var previousGtidsEvent mysql.PreviousGtidsEvent
+			err = previousGtidsEvent.Parse(&event, reader.Buffer)
+			if err != nil {
+				return
+			}
+			previousGtids = previousGtidsEvent.Gtids
+		}
+		entry.Append(event.EventSize, event.EventType, gtid, previousGtids)
+	}
+}
+
+func (self *BinlogRelay) saveBinlogIndex(entry *BinlogIndexEntry) error {
+	data := strings.Join(entry.records(), "\n") + "\n"
+	return util.WriteFileAtomic(self.indexPath(entry.Name), []byte(data))
+}
+
+// cut the binlog of index at pos, its index is kept till the last gtid checkpoint before and rescanned after
+func (self *BinlogRelay) truncateBinlog(index int, pos uint32) (err error) {
+	entry := self.BinlogInfoByIndex(index)
+	if err = os.Truncate(self.NameToPath(entry.Name), int64(pos)); err != nil {
+		return
+	}
+	truncated := BinlogIndexEntry{Name: entry.Name, Size: mysql.LOG_POS_START}
+	n := 0
+	for n < len(entry.GtidPos) && entry.GtidPos[n].Pos <= pos {
+		n++
+	}
+	if n > 0 {
+		checkpoint := entry.GtidPos[n-1]
+		truncated.Count, truncated.Size, truncated.gtids = checkpoint.Index, checkpoint.Pos, checkpoint.Gtids.Clone()
+		truncated.PreviousGtids = entry.PreviousGtids
+		truncated.GtidPos = append(truncated.GtidPos, entry.GtidPos[:n-1]...)
+		for _, eventPos := range entry.EventPos {
+			if eventPos.Index < checkpoint.Index {
+				truncated.EventPos = append(truncated.EventPos, eventPos)
+			}
+		}
+	}
+	if err = self.scanBinlog(&truncated); err != nil {
+		return
+	}
+	truncated.loaded = true
+	self.lock.Lock()
+	self.fileIndex[index] = truncated
+	self.notifyUpdated()
+	self.lock.Unlock()
+	return self.saveBinlogIndex(&truncated)
+}
+
+func (self *BinlogRelay) openIndexFile(name string, create bool) (err error) {
+	self.closeIndexFile()
+	flag := os.O_WRONLY | os.O_APPEND | os.O_CREATE
+	if create {
+		flag |= os.O_TRUNC
+	}
+	self.indexFile, err = os.OpenFile(self.indexPath(name), flag, 0664)
+	return
+}
+
+// record the final state of the binlog written
+func (self *BinlogRelay) closeIndexFile() {
+	if self.indexFile == nil {
+		return
+	}
+	self.lock.RLock()
+	record := self.fileIndex[self.curFileId].stateRecord()
+	self.lock.RUnlock()
+	self.writeIndexRecords([]string{record})
+	self.indexFile.Close()
+	self.indexFile = nil
+}
+
+func (self *BinlogRelay) writeIndexRecords(records []string) {
+	if self.indexFile == nil || len(records) == 0 {
+		return
+	}
+	_, err := self.indexFile.WriteString(strings.Join(records, "\n") + "\n")
+	if err != nil {
+		// binlogs are still good, index is rebuilt on next load
+		self.logger.Warn("write index: %s", err.Error())
+		self.indexFile.Close()
+		self.indexFile = nil
+	}
+}
+
+// index of binlog with events and gtids loaded
+func (self *BinlogRelay) LoadedBinlogInfoByIndex(index int) (entry BinlogIndexEntry, err error) {
+	entry = self.BinlogInfoByIndex(index)
+	if entry.loaded {
+		return
+	}
+	// binlogs not loaded are never written any more
+	err = self.loadBinlogIndex(&entry)
+	if err != nil {
+		return
+	}
+	self.lock.Lock()
+	if index < len(self.fileIndex) && self.fileIndex[index].Name == entry.Name {
+		self.fileIndex[index] = entry
+	}
+	self.lock.Unlock()
+	return
+}
+
+// whether an event of the binlog at index starts at pos, the end of the binlog included.
+// if not, before and after are the starts of the events around pos, scanned from the nearest EventPos
+func (self *BinlogRelay) CheckEventBoundary(index int, pos uint32) (ok bool, before uint32, after uint32, err error) {
+	entry, err := self.LoadedBinlogInfoByIndex(index)
+	if err != nil {
+		return
+	}
+	if pos == mysql.LOG_POS_START || pos == entry.Size {
+		return true, pos, pos, nil
+	}
+	start := uint32(mysql.LOG_POS_START)
+	i := sort.Search(len(entry.EventPos), func(i int) bool { return entry.EventPos[i].Pos > pos })
+	if i > 0 {
+		start = entry.EventPos[i-1].Pos
+	}
+	reader, err := OpenBinlogReader(self.NameToPath(entry.Name))
+	if err != nil {
+		return
+	}
+	defer reader.Close()
+	if err = reader.Seek(start); err != nil {
+		return
+	}
+	before = reader.Pos
+	for reader.Pos < pos && reader.Pos < entry.Size {
+		before = reader.Pos
+		if _, err = reader.Next(); err != nil {
+			return
+		}
+	}
+	if reader.Pos == pos {
+		return true, pos, pos, nil
+	}
+	return false, before, reader.Pos, nil
+}
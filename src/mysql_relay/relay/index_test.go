@@ -0,0 +1,87 @@
+package relay
+
+import (
+	"io/ioutil"
+	"mysql_relay/mysql"
+	"os"
+	"testing"
+)
+
+func TestBinlogIndexRecords(t *testing.T) {
+	sid, _ := mysql.ParseSid("3e11fa47-71ca-11e1-9e33-c80aa9429562")
+	previous, _ := mysql.ParseGtidSet("3e11fa47-71ca-11e1-9e33-c80aa9429562:1-10")
+	entry := BinlogIndexEntry{Size: mysql.LOG_POS_START}
+	entry.Append(120, mysql.FORMAT_DESCRIPTION_EVENT, mysql.Gtid{}, nil)
+	entry.Append(71, mysql.PREVIOUS_GTIDS_EVENT, mysql.Gtid{}, previous)
+	for gno := uint64(11); gno <= 1000; gno++ {
+		entry.Append(65, mysql.GTID_EVENT, mysql.Gtid{Sid: sid, Gno: gno}, nil)
+		entry.Append(4096, mysql.WRITE_ROWS_EVENTv2, mysql.Gtid{}, nil)
+		entry.Append(31, mysql.XID_EVENT, mysql.Gtid{}, nil)
+	}
+	if len(entry.GtidPos) == 0 || len(entry.EventPos) != int(entry.Count+EVENT_POS_INTERVAL-1)/EVENT_POS_INTERVAL {
+		t.Fatalf("indexed %d gtids, %d events", len(entry.GtidPos), len(entry.EventPos))
+	}
+
+	var loaded BinlogIndexEntry
+	for _, record := range entry.records() {
+		if err := loaded.loadRecord(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if loaded.Size != entry.Size || loaded.Count != entry.Count || !loaded.PreviousGtids.Equals(previous) ||
+		!loaded.gtids.Equals(entry.gtids) || len(loaded.GtidPos) != len(entry.GtidPos) || len(loaded.EventPos) != len(entry.EventPos) {
+		t.Errorf("loaded: %d %d %s", loaded.Size, loaded.Count, loaded.gtids.String())
+	}
+
+	gtids, _ := mysql.ParseGtidSet("3e11fa47-71ca-11e1-9e33-c80aa9429562:1-500")
+	pos := entry.GtidStart(gtids)
+	for _, checkpoint := range entry.GtidPos {
+		if checkpoint.Pos > pos && gtids.Contains(checkpoint.Gtids) || checkpoint.Pos <= pos && !gtids.Contains(checkpoint.Gtids) {
+			t.Errorf("start at %d, checkpoint %d: %s", pos, checkpoint.Pos, checkpoint.Gtids.String())
+		}
+	}
+	if entry.GtidStart(previous) != mysql.LOG_POS_START {
+		t.Fail()
+	}
+}
+
+func TestCheckEventBoundary(t *testing.T) {
+	dir, err := ioutil.TempDir("", "relay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	relay := BinlogRelay{localDir: dir, startFile: "log-bin.000001"}
+	binlog := buildTestBinlog(EVENT_POS_INTERVAL + 10)
+	if err = ioutil.WriteFile(relay.NameToPath("log-bin.000001"), binlog, 0664); err != nil {
+		t.Fatal(err)
+	}
+	if err = relay.ReloadPos(); err != nil {
+		t.Fatal(err)
+	}
+	entry := relay.BinlogInfoByIndex(0)
+	if len(entry.EventPos) < 2 {
+		t.Fatalf("event positions: %v", entry.EventPos)
+	}
+	fdeSize := mysql.ENDIAN.Uint32(binlog[4+9:])
+	xidSize := mysql.ENDIAN.Uint32(binlog[4+fdeSize+9:])
+	last := entry.EventPos[len(entry.EventPos)-1].Pos
+	cases := []struct {
+		pos           uint32
+		ok            bool
+		before, after uint32
+	}{
+		{mysql.LOG_POS_START, true, 4, 4},
+		{4 + fdeSize, true, 4 + fdeSize, 4 + fdeSize},
+		{4 + fdeSize + 1, false, 4 + fdeSize, 4 + fdeSize + xidSize},
+		{last + xidSize + 3, false, last + xidSize, last + 2*xidSize},
+		{entry.Size, true, entry.Size, entry.Size},
+		{entry.Size - 1, false, entry.Size - xidSize, entry.Size},
+	}
+	for _, c := range cases {
+		ok, before, after, err := relay.CheckEventBoundary(0, c.pos)
+		if err != nil || ok != c.ok || before != c.before || after != c.after {
+			t.Errorf("%d: %v %d %d %v", c.pos, ok, before, after, err)
+		}
+	}
+}
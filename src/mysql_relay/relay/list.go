@@ -0,0 +1,99 @@
+package relay
+
+import (
+	"fmt"
+	"io/ioutil"
+	"mysql_relay/mysql"
+	"mysql_relay/util"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// binlogs relayed are listed in <prefix>.index as mysqld does, readable by mysqlbinlog and other tools
+const BINLOG_LIST_SUFFIX = ".index"
+
+// the last position written, "<binlog> <pos>"
+const POSITION_STATE_FILE = "relay.pos"
+
+func (self *BinlogRelay) binlogListPath() string {
+	prefix, _, err := mysql.ParseBinlogName(self.startFile)
+	if err != nil {
+		prefix = self.startFile
+	}
+	return self.NameToPath(prefix + BINLOG_LIST_SUFFIX)
+}
+
+// names of binlogs listed, nil if there is no list
+func (self *BinlogRelay) loadBinlogList() (names []string, err error) {
+	data, err := ioutil.ReadFile(self.binlogListPath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return
+	}
+	names = make([]string, 0, 16)
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" {
+			names = append(names, filepath.Base(line))
+		}
+	}
+	return
+}
+
+func (self *BinlogRelay) saveBinlogList() error {
+	self.lock.RLock()
+	lines := make([]string, 0, len(self.fileIndex))
+	for _, entry := range self.fileIndex {
+		if entry.purged {
+			continue
+		}
+		lines = append(lines, "."+string(os.PathSeparator)+entry.Name+"\n")
+	}
+	self.lock.RUnlock()
+	return util.WriteFileAtomic(self.binlogListPath(), []byte(strings.Join(lines, "")))
+}
+
+// binlogs of relay directories without a list, probed by names in order
+func (self *BinlogRelay) probeBinlogList() (names []string, err error) {
+	names = make([]string, 0, 16)
+	filename := self.startFile
+	for {
+		_, err = os.Stat(self.NameToPath(filename))
+		if os.IsNotExist(err) {
+			return names, nil
+		} else if err != nil {
+			return
+		}
+		names = append(names, filename)
+		filename, err = mysql.NextBinlogName(filename)
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (self *BinlogRelay) loadPositionState() (name string, pos uint32, err error) {
+	data, err := ioutil.ReadFile(self.NameToPath(POSITION_STATE_FILE))
+	if err != nil {
+		return
+	}
+	_, err = fmt.Sscanf(string(data), "%s %d", &name, &pos)
+	return
+}
+
+// the position of the last event written to the current binlog
+func (self *BinlogRelay) savePositionState() {
+	self.lock.RLock()
+	if len(self.fileIndex) == 0 {
+		self.lock.RUnlock()
+		return
+	}
+	entry := &self.fileIndex[self.curFileId]
+	data := fmt.Sprintf("%s %d\n", entry.Name, entry.Size)
+	self.lock.RUnlock()
+	if err := util.WriteFileAtomic(self.NameToPath(POSITION_STATE_FILE), []byte(data)); err != nil {
+		self.logger.Warn("save position: %s", err.Error())
+	}
+}
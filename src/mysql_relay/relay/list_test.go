@@ -0,0 +1,37 @@
+package relay
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestReloadPosFromBinlogList(t *testing.T) {
+	dir, err := ioutil.TempDir("", "relay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	relay := BinlogRelay{localDir: dir, startFile: "log-bin.000001"}
+	binlog := buildTestBinlog(3)
+	// a gap after a binlog removed by hand
+	for _, name := range []string{"log-bin.000001", "log-bin.000003"} {
+		if err = ioutil.WriteFile(relay.NameToPath(name), binlog, 0664); err != nil {
+			t.Fatal(err)
+		}
+	}
+	list := "./log-bin.000001\n./log-bin.000002\n./log-bin.000003\n"
+	if err = ioutil.WriteFile(relay.NameToPath("log-bin.index"), []byte(list), 0664); err != nil {
+		t.Fatal(err)
+	}
+	if err = relay.ReloadPos(); err != nil {
+		t.Fatal(err)
+	}
+	if len(relay.fileIndex) != 2 || relay.startFile != "log-bin.000003" || relay.startPos != uint32(len(binlog)) {
+		t.Fatalf("reloaded %d binlogs, at %s:%d", len(relay.fileIndex), relay.startFile, relay.startPos)
+	}
+	names, err := relay.loadBinlogList()
+	if err != nil || len(names) != 2 || names[0] != "log-bin.000001" || names[1] != "log-bin.000003" {
+		t.Errorf("list saved: %v %v", names, err)
+	}
+}
@@ -0,0 +1,23 @@
+package relay
+
+import (
+	"mysql_relay/util"
+)
+
+// labeled by upstream name, relays of the same upstream add to the same metrics
+var (
+	eventsRelayed = util.Metrics.NewCounterVec("mysql_relay_events_relayed_total",
+		"Events received from upstream and written to relay binlogs.", "upstream")
+	bytesRelayed = util.Metrics.NewCounterVec("mysql_relay_bytes_relayed_total",
+		"Bytes of events written to relay binlogs.", "upstream")
+	fsyncSeconds = util.Metrics.NewHistogramVec("mysql_relay_fsync_seconds",
+		"Latency of syncing relay binlogs to disk.", util.LatencyBuckets, "upstream")
+	semisyncAcksSent = util.Metrics.NewCounterVec("mysql_relay_semisync_acks_sent_total",
+		"Semisync acks sent to upstream.", "upstream")
+	semisyncAckTimeouts = util.Metrics.NewCounterVec("mysql_relay_semisync_ack_timeouts_total",
+		"Timeouts waiting for the quorum of replicas to ack before acking upstream.", "upstream")
+	semisyncAcksReceived = util.Metrics.NewCounterVec("mysql_relay_semisync_acks_received_total",
+		"Semisync acks received from replicas.", "upstream")
+	checksumMismatches = util.Metrics.NewCounterVec("mysql_relay_checksum_mismatches_total",
+		"Events received from upstream with bad checksums, discarded.", "upstream")
+)
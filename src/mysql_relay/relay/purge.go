@@ -0,0 +1,133 @@
+package relay
+
+import (
+	"os"
+	"time"
+)
+
+// binlogs are purged when older than MaxAge, or beyond MaxSize in total, but at least KeepFiles are kept.
+// 0 for no limit
+type RetentionPolicy struct {
+	MaxAge    time.Duration
+	MaxSize   uint64
+	KeepFiles int
+}
+
+func (self *BinlogRelay) SetRetentionPolicy(policy RetentionPolicy) {
+	self.retention = policy
+}
+
+// index of the first binlog not purged
+func (self *BinlogRelay) FirstIndex() int {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	for i, entry := range self.fileIndex {
+		if !entry.purged {
+			return i
+		}
+	}
+	return len(self.fileIndex)
+}
+
+// binlogs before index are removed with their sidecar index, the binlog being written is never removed
+func (self *BinlogRelay) PurgeBefore(index int) (n int, err error) {
+	self.lock.Lock()
+	if index > self.curFileId {
+		index = self.curFileId
+	}
+	names := make([]string, 0, 4)
+	for i := 0; i < index; i++ {
+		if !self.fileIndex[i].purged {
+			self.fileIndex[i].purged = true
+			names = append(names, self.fileIndex[i].Name)
+		}
+	}
+	self.lock.Unlock()
+	if len(names) == 0 {
+		return
+	}
+	// not listed before removed, so a crash never leaves a listed binlog missing
+	if err = self.saveBinlogList(); err != nil {
+		return
+	}
+	for _, name := range names {
+		self.logger.Info("purge %s", name)
+		if err = os.Remove(self.NameToPath(name)); err != nil && !os.IsNotExist(err) {
+			return
+		}
+		if err = os.Remove(self.indexPath(name)); err != nil && !os.IsNotExist(err) {
+			return
+		}
+		err = nil
+		n++
+	}
+	return
+}
+
+// index of the first binlog modified at or after t
+func (self *BinlogRelay) FindIndexModifiedSince(t time.Time) (index int, err error) {
+	self.lock.RLock()
+	n := len(self.fileIndex)
+	self.lock.RUnlock()
+	for index = self.FirstIndex(); index < n; index++ {
+		var stat os.FileInfo
+		stat, err = os.Stat(self.PathByIndex(index))
+		if err != nil {
+			return
+		}
+		if !stat.ModTime().Before(t) {
+			return
+		}
+	}
+	return
+}
+
+// the first binlog to keep as the retention policy
+func (self *BinlogRelay) retentionIndex(now time.Time) (index int, err error) {
+	policy := self.retention
+	self.lock.RLock()
+	n := len(self.fileIndex)
+	self.lock.RUnlock()
+	first := self.FirstIndex()
+	index = first
+	if policy.MaxAge > 0 {
+		index, err = self.FindIndexModifiedSince(now.Add(-policy.MaxAge))
+		if err != nil {
+			return
+		}
+	}
+	if policy.MaxSize > 0 {
+		total := uint64(0)
+		for i := n - 1; i >= first; i-- {
+			total += uint64(self.BinlogInfoByIndex(i).Size)
+			if total > policy.MaxSize {
+				if i+1 > index {
+					index = i + 1
+				}
+				break
+			}
+		}
+	}
+	if policy.KeepFiles > 0 && index > n-policy.KeepFiles {
+		index = n - policy.KeepFiles
+	}
+	if index < first {
+		index = first
+	}
+	return
+}
+
+// purge binlogs as the retention policy, binlogs at or after protected are kept
+func (self *BinlogRelay) PurgeByRetention(protected int) (n int, err error) {
+	if self.retention == (RetentionPolicy{}) {
+		return
+	}
+	index, err := self.retentionIndex(time.Now())
+	if err != nil {
+		return
+	}
+	if index > protected {
+		index = protected
+	}
+	return self.PurgeBefore(index)
+}
@@ -0,0 +1,54 @@
+package relay
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestPurgeByRetention(t *testing.T) {
+	dir, err := ioutil.TempDir("", "relay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	relay := BinlogRelay{localDir: dir, startFile: "log-bin.000001"}
+	binlog := buildTestBinlog(3)
+	for _, name := range []string{"log-bin.000001", "log-bin.000002", "log-bin.000003", "log-bin.000004"} {
+		if err = ioutil.WriteFile(relay.NameToPath(name), binlog, 0664); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = relay.ReloadPos(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the one being sent is kept
+	relay.SetRetentionPolicy(RetentionPolicy{MaxSize: uint64(len(binlog)), KeepFiles: 2})
+	if n, err := relay.PurgeByRetention(1); n != 1 || err != nil {
+		t.Fatalf("purged %d: %v", n, err)
+	}
+	if n, err := relay.PurgeByRetention(4); n != 1 || err != nil {
+		t.Fatalf("purged %d: %v", n, err)
+	}
+	if relay.FirstIndex() != 2 || relay.FindIndex("log-bin.000002") >= 0 || relay.FindIndex("log-bin.000003") != 2 {
+		t.Errorf("first binlog %d", relay.FirstIndex())
+	}
+	if _, err = os.Stat(relay.NameToPath("log-bin.000002")); !os.IsNotExist(err) {
+		t.Error("binlog not removed")
+	}
+	names, _ := relay.loadBinlogList()
+	if len(names) != 2 || names[0] != "log-bin.000003" {
+		t.Errorf("listed %v", names)
+	}
+
+	// the binlog being written is never purged
+	relay.SetRetentionPolicy(RetentionPolicy{MaxAge: time.Nanosecond})
+	if n, _ := relay.PurgeBefore(4); n != 1 || relay.FirstIndex() != 3 {
+		t.Errorf("purged %d, first binlog %d", n, relay.FirstIndex())
+	}
+	if index, _ := relay.retentionIndex(time.Now().Add(time.Hour)); index != 4 {
+		t.Errorf("retention index %d", index)
+	}
+}
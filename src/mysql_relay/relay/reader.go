@@ -0,0 +1,173 @@
+package relay
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"mysql_relay/mysql"
+	"os"
+)
+
+var INCOMPLETE_EVENT = errors.New("incomplete event")
+var BAD_EVENT_HEADER = errors.New("bad event header")
+
+const BINLOG_READER_BUFFER_SIZE = 4096
+
+// reads events of a local binlog one by one.
+// bodies of events needed by index are loaded to Buffer, with a leading ok byte as a packet
+type BinlogReader struct {
+	file        *os.File
+	size        uint32
+	Pos         uint32
+	HasChecksum bool
+	Buffer      []byte
+
+	// validate LogPos of events, and checksums if any
+	Verify bool
+}
+
+func OpenBinlogReader(path string) (ret *BinlogReader, err error) {
+	var f *os.File
+	f, err = os.Open(path)
+	if err != nil {
+		return
+	}
+	var stat os.FileInfo
+	stat, err = f.Stat()
+	if err != nil {
+		f.Close()
+		return
+	}
+	ret = &BinlogReader{
+		file:   f,
+		size:   uint32(stat.Size()),
+		Pos:    mysql.LOG_POS_START,
+		Buffer: make([]byte, BINLOG_READER_BUFFER_SIZE),
+	}
+	return
+}
+
+func (self *BinlogReader) Close() error {
+	return self.file.Close()
+}
+
+func (self *BinlogReader) Size() uint32 {
+	return self.size
+}
+
+// continue reading at pos, the FORMAT_DESCRIPTION_EVENT is read first to know whether events have checksum
+func (self *BinlogReader) Seek(pos uint32) (err error) {
+	self.Pos = mysql.LOG_POS_START
+	if pos > mysql.LOG_POS_START {
+		var event mysql.BinlogEventPacket
+		event, err = self.Next()
+		if err != nil {
+			return
+		}
+		if event.EventType != mysql.FORMAT_DESCRIPTION_EVENT {
+			return fmt.Errorf("not a FORMAT_DESCRIPTION_EVENT")
+		}
+		self.Pos = pos
+	}
+	return
+}
+
+func needEventBody(eventType byte) bool {
+	switch eventType {
+	case mysql.FORMAT_DESCRIPTION_EVENT, mysql.GTID_EVENT, mysql.ANONYMOUS_GTID_EVENT, mysql.PREVIOUS_GTIDS_EVENT:
+		return true
+	}
+	return false
+}
+
+// returns io.EOF at the end of file, INCOMPLETE_EVENT if the last event is not completely written
+func (self *BinlogReader) Next() (event mysql.BinlogEventPacket, err error) {
+	if self.Pos >= self.size {
+		err = io.EOF
+		return
+	}
+	if self.Pos+mysql.BinlogEventHeaderSize > self.size {
+		err = INCOMPLETE_EVENT
+		return
+	}
+	self.Buffer[0] = '\x00'
+	_, err = self.file.ReadAt(self.Buffer[1:mysql.BinlogEventHeaderSize+1], int64(self.Pos))
+	if err != nil {
+		return
+	}
+	event.FromBuffer(self.Buffer[:])
+	event.PacketLength = event.EventSize + 1
+	event.BodyLength = int(event.EventSize) - mysql.BinlogEventHeaderSize
+	event.HasChecksum = self.HasChecksum
+	if event.EventSize < mysql.BinlogEventHeaderSize || self.Pos+event.EventSize > self.size {
+		err = INCOMPLETE_EVENT
+		return
+	}
+	if self.Verify && event.LogPos != 0 && event.LogPos != self.Pos+event.EventSize {
+		err = BAD_EVENT_HEADER
+		return
+	}
+	if needEventBody(event.EventType) {
+		if int(event.PacketLength) > len(self.Buffer) {
+			buffer := make([]byte, event.PacketLength)
+			copy(buffer, self.Buffer[:mysql.BinlogEventHeaderSize+1])
+			self.Buffer = buffer
+		}
+		_, err = self.file.ReadAt(self.Buffer[mysql.BinlogEventHeaderSize+1:event.PacketLength],
+			int64(self.Pos+mysql.BinlogEventHeaderSize))
+		if err != nil {
+			return
+		}
+		if event.EventType == mysql.FORMAT_DESCRIPTION_EVENT {
+			var fde mysql.FormatDescriptionEvent
+			err = fde.Parse(&event, self.Buffer[:])
+			if err != nil {
+				return
+			}
+			self.HasChecksum = (fde.ChecksumAlgorism == 1)
+		}
+	}
+	if self.Verify && self.HasChecksum {
+		if err = self.verifyChecksum(event.EventSize); err != nil {
+			return
+		}
+	}
+	self.Pos += event.EventSize
+	return
+}
+
+// load the body of the event just read to Buffer, for events of which Next reads only the header
+func (self *BinlogReader) LoadBody(event *mysql.BinlogEventPacket) (err error) {
+	if needEventBody(event.EventType) {
+		return
+	}
+	if int(event.PacketLength) > len(self.Buffer) {
+		buffer := make([]byte, event.PacketLength)
+		copy(buffer, self.Buffer[:mysql.BinlogEventHeaderSize+1])
+		self.Buffer = buffer
+	}
+	_, err = self.file.ReadAt(self.Buffer[mysql.BinlogEventHeaderSize+1:event.PacketLength],
+		int64(self.Pos-event.EventSize+mysql.BinlogEventHeaderSize))
+	return
+}
+
+func (self *BinlogReader) verifyChecksum(eventSize uint32) (err error) {
+	if eventSize < mysql.BinlogEventHeaderSize+4 {
+		return BAD_EVENT_HEADER
+	}
+	checksum := crc32.NewIEEE()
+	_, err = io.Copy(checksum, io.NewSectionReader(self.file, int64(self.Pos), int64(eventSize-4)))
+	if err != nil {
+		return
+	}
+	var expected [4]byte
+	_, err = self.file.ReadAt(expected[:], int64(self.Pos+eventSize-4))
+	if err != nil {
+		return
+	}
+	if mysql.ENDIAN.Uint32(expected[:]) != checksum.Sum32() {
+		return CHECKSUM_MISMATCH
+	}
+	return
+}
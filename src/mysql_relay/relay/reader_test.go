@@ -0,0 +1,70 @@
+package relay
+
+import (
+	"hash/crc32"
+	"io/ioutil"
+	"mysql_relay/mysql"
+	"os"
+	"testing"
+)
+
+// an event at pos of binlog with body and crc32
+func buildTestBinlogEvent(eventType byte, pos uint32, body []byte) []byte {
+	size := mysql.BinlogEventHeaderSize + len(body) + 4
+	event := make([]byte, size)
+	event[4] = eventType
+	mysql.ENDIAN.PutUint32(event[9:], uint32(size))
+	mysql.ENDIAN.PutUint32(event[13:], pos+uint32(size))
+	copy(event[mysql.BinlogEventHeaderSize:], body)
+	mysql.ENDIAN.PutUint32(event[size-4:], crc32.ChecksumIEEE(event[:size-4]))
+	return event
+}
+
+func buildTestBinlog(nEvents int) []byte {
+	body := make([]byte, 2+50+4+1+int(mysql.BINLOG_EVENT_END)+1)
+	mysql.ENDIAN.PutUint16(body, 4)
+	body[56] = mysql.BinlogEventHeaderSize
+	body[57+mysql.FORMAT_DESCRIPTION_EVENT-1] = byte(57 + mysql.BINLOG_EVENT_END)
+	body[len(body)-1] = mysql.BINLOG_CHECKSUM_ALG_CRC32
+	binlog := []byte{'\xfe', 'b', 'i', 'n'}
+	binlog = append(binlog, buildTestBinlogEvent(mysql.FORMAT_DESCRIPTION_EVENT, uint32(len(binlog)), body)...)
+	for i := 0; i < nEvents; i++ {
+		binlog = append(binlog, buildTestBinlogEvent(mysql.XID_EVENT, uint32(len(binlog)), make([]byte, 8))...)
+	}
+	return binlog
+}
+
+func TestRecoverBinlog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "relay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	relay := BinlogRelay{localDir: dir}
+	good := buildTestBinlog(10)
+	corrupt := buildTestBinlog(11)
+	corrupt[len(corrupt)-5] ^= 0xff
+	cases := []struct {
+		name   string
+		binlog []byte
+	}{
+		{"complete", good},
+		{"torn", buildTestBinlog(11)[:len(good)+20]},
+		{"torn header", buildTestBinlog(11)[:len(good)+10]},
+		{"corrupt", corrupt},
+	}
+	for _, c := range cases {
+		name := "log-bin.000001"
+		if err = ioutil.WriteFile(relay.NameToPath(name), c.binlog, 0664); err != nil {
+			t.Fatal(err)
+		}
+		entry := BinlogIndexEntry{Name: name}
+		if err = relay.recoverBinlog(&entry); err != nil {
+			t.Fatalf("%s: %s", c.name, err.Error())
+		}
+		stat, _ := os.Stat(relay.NameToPath(name))
+		if entry.Size != uint32(len(good)) || stat.Size() != int64(len(good)) || entry.Count != 11 {
+			t.Errorf("%s: recovered %d of %d bytes, %d events", c.name, entry.Size, stat.Size(), entry.Count)
+		}
+	}
+}
@@ -1,34 +1,21 @@
 package relay
 
 import (
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"io/ioutil"
 	"mysql_relay/mysql"
 	"mysql_relay/util"
 	"os"
 	"sync"
+	"time"
 )
 
-type BinlogIndexEventPosEntry struct {
-	Index uint32
-	Pos   uint32
-}
+const GTID_STATE_FILE = "relay.gtid"
 
-type BinlogIndexEntry struct {
-	Name  string
-	Size  uint32
-	Count uint32
-	//EventPos  []BinlogIndexEventPosEntry
-}
-
-func (self *BinlogIndexEntry) Append(size uint32) {
-	//if self.Count % 256 == 0 {
-	//    self.EventPos = append(self.EventPos, BinlogIndexEventPosEntry{ Index:self.Count, Pos:self.Size })
-	//}
-	self.Count++
-	self.Size += size
-}
+var WRITER_ENDED = errors.New("writer ended")
 
 type BinlogRelay struct {
 	name       string
@@ -44,19 +31,43 @@ type BinlogRelay struct {
 
 	fileIndex       []BinlogIndexEntry
 	curFileId       int
+	indexFile       *os.File
 	semisync        bool
-	heartbeatPeriod uint32
+	heartbeatPeriod time.Duration
 	networkTimeout  uint32
 	logger          util.Logger
+
+	gtidMode         bool
+	retrievedGtids   mysql.GtidSet
+	upstreamGtidMode string
+
+	checksumErrorPolicy string
+	stopped             bool
+	negotiateChecksum   bool
+	binlogChecksum      string
+	rewriteServerId     uint32
+	acker               semisyncAcker
+	retention           RetentionPolicy
+	status              dumpStatus
+	updated             chan struct{} // closed and renewed when the position moves, guarded by lock
 }
 
 type writeTask struct {
-	buffer []byte
-	name   string
-	pos    int64
-	size   uint32
-	seq    byte
-	ack    bool
+	buffer   []byte
+	name     string
+	pos      int64
+	size     uint32
+	eventEnd bool
+	ack      bool
+	ackName  string
+	ackPos   uint64
+	commit   mysql.Gtid
+	checksum bool // whether the event ends with crc32
+
+	// for index of the event
+	eventType     byte
+	gtid          mysql.Gtid
+	previousGtids mysql.GtidSet
 }
 
 func (self *BinlogRelay) Init(name string, client mysql.Client, localDir string, startFile string) (err error) {
@@ -66,6 +77,7 @@ func (self *BinlogRelay) Init(name string, client mysql.Client, localDir string,
 	self.startFile = startFile
 	self.fileIndex = make([]BinlogIndexEntry, 0, 16)
 	self.syncBinlog = 1
+	self.acker.Init()
 
 	logPath := localDir + string(os.PathSeparator) + "relay.log"
 	err = self.logger.ToFile(logPath)
@@ -76,26 +88,269 @@ func (self *BinlogRelay) Init(name string, client mysql.Client, localDir string,
 	self.logger.SetPrefix("[upstream:" + name + "]")
 	self.logger.Info("relay inited")
 	self.ReloadPos()
+	self.loadBinlogChecksum()
+	err = self.loadRetrievedGtids()
 	return
 }
 
+// the connection to upstream dumped by the next Run, the relay is kept across reconnections
+func (self *BinlogRelay) SetClient(client mysql.Client) {
+	self.lock.Lock()
+	self.client = client
+	self.lock.Unlock()
+}
+
 func (self *BinlogRelay) SetSemisync(b bool) {
 	self.semisync = b
 }
 
-func (self *BinlogRelay) SetHeartbeatPeriod(n uint32) {
-	self.heartbeatPeriod = n
+// upstream sends heartbeats when idle for period, 0 to disable
+func (self *BinlogRelay) SetHeartbeatPeriod(period time.Duration) {
+	self.heartbeatPeriod = period
+}
+
+// in gtid mode, relay dumps with COM_BINLOG_DUMP_GTID and names local binlogs itself,
+// so the upstream can be switched to another master
+func (self *BinlogRelay) SetGtidMode(b bool) {
+	self.gtidMode = b
+}
+
+func (self *BinlogRelay) GtidMode() bool {
+	return self.gtidMode
+}
+
+func (self *BinlogRelay) SetChecksumErrorPolicy(policy string) {
+	self.checksumErrorPolicy = policy
+}
+
+// dump with the checksum algorithm of upstream instead of NONE
+func (self *BinlogRelay) SetNegotiateChecksum(b bool) {
+	self.negotiateChecksum = b
+}
+
+// checksum algorithm of binlogs relayed, CRC32 or NONE
+func (self *BinlogRelay) BinlogChecksum() string {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	if self.binlogChecksum == "" {
+		return "NONE"
+	}
+	return self.binlogChecksum
+}
+
+func (self *BinlogRelay) setBinlogChecksum(checksum bool) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if checksum {
+		self.binlogChecksum = "CRC32"
+	} else {
+		self.binlogChecksum = "NONE"
+	}
+}
+
+// the last binlog tells the checksum algorithm before upstream is dumped
+func (self *BinlogRelay) loadBinlogChecksum() {
+	if len(self.fileIndex) == 0 {
+		return
+	}
+	reader, err := OpenBinlogReader(self.PathByIndex(len(self.fileIndex) - 1))
+	if err != nil {
+		self.logger.Warn("load binlog checksum: %s", err.Error())
+		return
+	}
+	defer reader.Close()
+	event, err := reader.Next()
+	if err != nil || event.EventType != mysql.FORMAT_DESCRIPTION_EVENT {
+		return
+	}
+	self.setBinlogChecksum(reader.HasChecksum)
+}
+
+func (self *BinlogRelay) queryUpstreamChecksum() string {
+	value, err := self.client.QueryValue("SELECT @@GLOBAL.BINLOG_CHECKSUM")
+	if err != nil {
+		// not supported before 5.6
+		self.logger.Warn("query binlog checksum: %s", err.Error())
+		return "NONE"
+	} else if value.IsNull {
+		return "NONE"
+	}
+	return value.Value
+}
+
+// server_id of events written is replaced if not 0
+func (self *BinlogRelay) SetRewriteServerId(serverId uint32) {
+	self.rewriteServerId = serverId
+}
+
+// whether the upstream should not be dumped any more
+func (self *BinlogRelay) Stopped() bool {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	return self.stopped
+}
+
+// @@GLOBAL.GTID_MODE of upstream
+func (self *BinlogRelay) UpstreamGtidMode() string {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	if self.upstreamGtidMode == "" {
+		return "OFF"
+	}
+	return self.upstreamGtidMode
+}
+
+func (self *BinlogRelay) queryUpstreamGtidMode() {
+	mode := "OFF"
+	value, err := self.client.QueryValue("SELECT @@GLOBAL.GTID_MODE")
+	if err != nil {
+		// not supported before 5.6
+		self.logger.Warn("query gtid mode: %s", err.Error())
+	} else if !value.IsNull {
+		mode = value.Value
+	}
+	self.lock.Lock()
+	self.upstreamGtidMode = mode
+	self.lock.Unlock()
+}
+
+func (self *BinlogRelay) RetrievedGtids() mysql.GtidSet {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	return self.retrievedGtids.Clone()
+}
+
+func (self *BinlogRelay) loadRetrievedGtids() (err error) {
+	self.retrievedGtids = mysql.NewGtidSet()
+	var buf []byte
+	buf, err = ioutil.ReadFile(self.NameToPath(GTID_STATE_FILE))
+	if err == nil {
+		self.retrievedGtids, err = mysql.ParseGtidSet(string(buf))
+		if err != nil {
+			self.logger.Error("parse gtid state: %s", err.Error())
+			return
+		}
+	} else if !os.IsNotExist(err) {
+		self.logger.Error("load gtid state: %s", err.Error())
+		return
+	}
+	err = nil
+	// the state is saved when a binlog is created, transactions committed since are in the last binlog
+	if len(self.fileIndex) > 0 && self.fileIndex[self.curFileId].loaded {
+		var tail binlogTail
+		tail, err = self.scanBinlogTail(&self.fileIndex[self.curFileId])
+		if err != nil {
+			self.logger.Error("scan gtids committed: %s", err.Error())
+			return
+		}
+		self.retrievedGtids.Union(tail.committed)
+	}
+	self.logger.Info("retrieved gtid set: %s", self.retrievedGtids.String())
+	return
+}
+
+func (self *BinlogRelay) addRetrievedGtid(gtid mysql.Gtid) {
+	self.lock.Lock()
+	self.retrievedGtids.Add(gtid)
+	self.lock.Unlock()
+}
+
+// saved before a binlog is created and when the writer ends, after binlogs written are synced
+func (self *BinlogRelay) saveRetrievedGtids() error {
+	return util.WriteFileAtomic(self.NameToPath(GTID_STATE_FILE), []byte(self.RetrievedGtids().String()))
+}
+
+// the end of a binlog, scanned from its last gtid checkpoint
+type binlogTail struct {
+	committed mysql.GtidSet // gtids committed till the end of the binlog
+	end       uint32        // end of the last event out of transactions
+	rotated   bool          // the event before end is a ROTATE_EVENT
+	checksum  bool
+}
+
+func (self *BinlogRelay) scanBinlogTail(entry *BinlogIndexEntry) (tail binlogTail, err error) {
+	tail.end = mysql.LOG_POS_START
+	tail.committed = mysql.NewGtidSet()
+	if n := len(entry.GtidPos); n > 0 {
+		tail.end = entry.GtidPos[n-1].Pos
+		tail.committed = entry.GtidPos[n-1].Gtids.Clone()
+	} else if entry.PreviousGtids != nil {
+		tail.committed = entry.PreviousGtids.Clone()
+	}
+	reader, err := OpenBinlogReader(self.NameToPath(entry.Name))
+	if err != nil {
+		return
+	}
+	defer reader.Close()
+	if err = reader.Seek(tail.end); err != nil {
+		return
+	}
+	var pending mysql.Gtid
+	for reader.Pos < entry.Size {
+		var event mysql.BinlogEventPacket
+		if event, err = reader.Next(); err != nil {
+			return
+		}
+		switch event.EventType {
+		case mysql.GTID_EVENT:
+			var gtidEvent mysql.GtidEvent
+			if err = gtidEvent.Parse(&event, reader.Buffer); err != nil {
+				return
+			}
+			pending = gtidEvent.Gtid
+		case mysql.ANONYMOUS_GTID_EVENT:
+			pending = mysql.Gtid{}
+		case mysql.XID_EVENT:
+			if !pending.IsEmpty() {
+				tail.committed.Add(pending)
+			}
+			pending = mysql.Gtid{}
+		case mysql.QUERY_EVENT:
+			if pending.IsEmpty() {
+				break
+			}
+			begin := false
+			if event.PacketLength <= BINLOG_READER_BUFFER_SIZE { // BEGIN is always small
+				if err = reader.LoadBody(&event); err != nil {
+					return
+				}
+				begin = isBeginQuery(&event, reader.Buffer)
+			}
+			if !begin {
+				tail.committed.Add(pending)
+				pending = mysql.Gtid{}
+			}
+		}
+		if pending.IsEmpty() {
+			tail.end = reader.Pos
+			tail.rotated = event.EventType == mysql.ROTATE_EVENT
+		}
+	}
+	tail.checksum = reader.HasChecksum
+	return
 }
 
 func (self *BinlogRelay) ReloadPos() error {
-	// TODO: use binlog list
-	filename := self.startFile
-	for {
+	names, err := self.loadBinlogList()
+	if err != nil {
+		self.logger.Error("load binlog list: %s", err.Error())
+		return err
+	}
+	listed := names != nil
+	if !listed {
+		names, err = self.probeBinlogList()
+		if err != nil {
+			self.logger.Error("%s", err.Error())
+			return err
+		}
+	}
+	for _, filename := range names {
 		stat, err := os.Stat(self.NameToPath(filename))
 		if os.IsNotExist(err) {
-			break
+			self.logger.Warn("binlog %s listed not found", filename)
+			continue
 		} else if err != nil {
-			self.logger.Error(err.Error())
+			self.logger.Error("%s", err.Error())
 			return err
 		}
 		self.startFile = filename
@@ -106,54 +361,153 @@ func (self *BinlogRelay) ReloadPos() error {
 			Size: uint32(stat.Size()),
 		})
 		self.curFileId = len(self.fileIndex) - 1
-
-		filename, err = mysql.NextBinlogName(self.startFile)
-		if err != nil {
-			self.logger.Error(err.Error())
+	}
+	if len(self.fileIndex) > 0 {
+		entry := &self.fileIndex[self.curFileId]
+		if err := self.recoverBinlog(entry); err != nil {
+			self.logger.Error("recover %s: %s", entry.Name, err.Error())
 			return err
 		}
+		self.startPos = entry.Size
+		if name, pos, err := self.loadPositionState(); err == nil && name == entry.Name && pos > entry.Size {
+			self.logger.Warn("%s written to %d, but only %d recovered", name, pos, entry.Size)
+		}
+		if !listed || len(self.fileIndex) != len(names) {
+			if err := self.saveBinlogList(); err != nil {
+				self.logger.Error("save binlog list: %s", err.Error())
+				return err
+			}
+		}
 	}
 	self.logger.Info("continue dump at %s:%d", self.startFile, self.startPos)
 	return nil
 }
 
+// a crash may leave a torn event at the end of the last binlog, written in chunks.
+// events are validated by header and checksum, the binlog is truncated to the last good one and indexed again
+func (self *BinlogRelay) recoverBinlog(entry *BinlogIndexEntry) (err error) {
+	path := self.NameToPath(entry.Name)
+	reader, err := OpenBinlogReader(path)
+	if err != nil {
+		return
+	}
+	reader.Verify = true
+	for err == nil {
+		_, err = reader.Next()
+	}
+	reader.Close()
+	end, size := reader.Pos, reader.Size()
+	switch err {
+	case io.EOF:
+		err = nil
+	case INCOMPLETE_EVENT, BAD_EVENT_HEADER, CHECKSUM_MISMATCH:
+		self.logger.Warn("%s at %s:%d, truncate %d bytes", err.Error(), entry.Name, end, size-end)
+		err = os.Truncate(path, int64(end))
+	}
+	if err != nil {
+		return
+	}
+	err = self.loadBinlogIndex(entry)
+	return
+}
+
 func (self *BinlogRelay) appendIndex(name string) {
 	self.lock.Lock()
 	defer self.lock.Unlock()
-	self.fileIndex = append(self.fileIndex, BinlogIndexEntry{
-		Name:  name,
-		Size:  0,
-		Count: 0,
-		//EventPos: make([]BinlogIndexEventPosEntry, 0, 16),
-	})
+	entry := BinlogIndexEntry{
+		Name:     name,
+		Size:     0,
+		Count:    0,
+		EventPos: make([]BinlogIndexEventPosEntry, 0, 16),
+		loaded:   true,
+	}
+	if n := len(self.fileIndex); n > 0 && self.fileIndex[n-1].Name == name {
+		// the last binlog with no event is written again
+		self.fileIndex[n-1] = entry
+	} else {
+		self.fileIndex = append(self.fileIndex, entry)
+	}
 	self.curFileId = len(self.fileIndex) - 1
 	self.fileIndex[self.curFileId].Size = 4
+	self.notifyUpdated()
 }
 
-func (self *BinlogRelay) appendEvent(size uint32) {
+func (self *BinlogRelay) appendEvent(size uint32, task *writeTask) {
 	self.lock.Lock()
-	defer self.lock.Unlock()
-	self.fileIndex[self.curFileId].Append(size)
-	self.logger.Info("append: %d: %v", self.curFileId, self.fileIndex[self.curFileId])
+	entry := &self.fileIndex[self.curFileId]
+	records := entry.Append(size, task.eventType, task.gtid, task.previousGtids)
+	self.logger.Info("append: %d: {%s %d %d}", self.curFileId, entry.Name, entry.Size, entry.Count)
+	self.notifyUpdated()
+	self.lock.Unlock()
+	self.writeIndexRecords(records)
 }
 
 func (self *BinlogRelay) CurrentPosition() (index int, pos uint32) {
 	self.lock.RLock()
 	defer self.lock.RUnlock()
-	return self.curFileId, self.fileIndex[index].Size
+	if len(self.fileIndex) == 0 {
+		return 0, mysql.LOG_POS_START
+	}
+	return self.curFileId, self.fileIndex[self.curFileId].Size
+}
+
+// wake up all waiting in PositionChanged, called with lock held
+func (self *BinlogRelay) notifyUpdated() {
+	if self.updated != nil {
+		close(self.updated)
+	}
+	self.updated = make(chan struct{})
+}
+
+// a channel closed once the position is no longer (index, pos), closed already if moved
+func (self *BinlogRelay) PositionChanged(index int, pos uint32) <-chan struct{} {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.updated == nil {
+		self.updated = make(chan struct{})
+	}
+	if len(self.fileIndex) > 0 && (self.curFileId != index || self.fileIndex[self.curFileId].Size != pos) {
+		moved := make(chan struct{})
+		close(moved)
+		return moved
+	}
+	return self.updated
 }
 
 func (self *BinlogRelay) FindIndex(name string) int {
 	self.lock.RLock()
 	defer self.lock.RUnlock()
 	for i, index := range self.fileIndex {
-		if index.Name == name {
+		if index.Name == name && !index.purged {
 			return i
 		}
 	}
 	return -1
 }
 
+// find the last binlog of which the PREVIOUS_GTIDS are all in gtids, and the position in it to start with.
+// returns -1 if binlogs containing gtids required are purged
+func (self *BinlogRelay) FindGtidStart(gtids mysql.GtidSet) (index int, pos uint32, err error) {
+	self.lock.RLock()
+	n := len(self.fileIndex)
+	self.lock.RUnlock()
+	var entry BinlogIndexEntry
+	for index = n - 1; index >= 0; index-- {
+		if self.BinlogInfoByIndex(index).purged {
+			return -1, 0, nil
+		}
+		entry, err = self.LoadedBinlogInfoByIndex(index)
+		if err != nil {
+			return
+		}
+		if gtids.Contains(entry.PreviousGtids) {
+			pos = entry.GtidStart(gtids)
+			return
+		}
+	}
+	return
+}
+
 func (self *BinlogRelay) NameByIndex(index int) string {
 	return self.BinlogInfoByIndex(index).Name
 }
@@ -164,6 +518,37 @@ func (self *BinlogRelay) BinlogInfoByIndex(index int) BinlogIndexEntry {
 	return self.fileIndex[index]
 }
 
+// binlogs not purged
+func (self *BinlogRelay) ListBinlogs() []BinlogIndexEntry {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	entries := make([]BinlogIndexEntry, 0, len(self.fileIndex))
+	for _, entry := range self.fileIndex {
+		if !entry.purged {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// bytes written after pos of the binlog, -1 if the binlog is not found
+func (self *BinlogRelay) BytesBehind(name string, pos uint32) int64 {
+	index := self.FindIndex(name)
+	if index < 0 {
+		return -1
+	}
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	behind := -int64(pos)
+	for _, entry := range self.fileIndex[index : self.curFileId+1] {
+		behind += int64(entry.Size)
+	}
+	if behind < 0 {
+		behind = 0
+	}
+	return behind
+}
+
 func (self *BinlogRelay) PathByIndex(index int) string {
 	name := self.NameByIndex(index)
 	return self.NameToPath(name)
@@ -177,16 +562,30 @@ func (self *BinlogRelay) getFileToWrite(name string, pos int64) (f *os.File, err
 	path := self.NameToPath(name)
 	//self.logger.Info("write at %s:%d", path, task.pos)
 	if pos <= mysql.LOG_POS_START {
+		if err = self.saveRetrievedGtids(); err != nil {
+			return
+		}
 		f, err = os.Create(path)
 		if err != nil {
 			return
 		}
 		// binlog header
 		_, err = f.Write([]byte{'\xfe', 'b', 'i', 'n'})
+		self.closeIndexFile()
+		self.savePositionState()
 		self.appendIndex(name)
+		if err == nil {
+			err = self.saveBinlogList()
+		}
+		if err == nil {
+			err = self.openIndexFile(name, true)
+		}
 
 	} else {
 		f, err = os.OpenFile(path, os.O_RDWR, 0664)
+		if err == nil {
+			err = self.openIndexFile(name, false)
+		}
 	}
 	if err != nil {
 		return
@@ -197,45 +596,109 @@ func (self *BinlogRelay) getFileToWrite(name string, pos int64) (f *os.File, err
 func (self *BinlogRelay) writeBinlog(bufChanIn chan<- []byte, bufChanOut <-chan writeTask) (err error) {
 	self.logger.Info("writer begin")
 	name := ""
-	seq := byte(0)
 	var f *os.File
+	eventSize := uint32(0)
+	eventStart := int64(0)
 	defer func() {
 		close(bufChanIn)
+		self.closeIndexFile()
+		self.savePositionState()
+		if saveErr := self.saveRetrievedGtids(); saveErr != nil {
+			self.logger.Error("save gtid state: %s", saveErr.Error())
+		}
 		self.logger.Info("writer ended")
 		if err != nil {
-			self.logger.Error("writer: " + err.Error())
+			self.logger.Error("writer: %s", err.Error())
+			self.client.Conn.Close() // stop dumper
+		}
+	}()
+	defer func() {
+		if f == nil {
+			return
+		}
+		if eventSize > 0 {
+			// chunks of the last event are discarded, the next run dumps it again
+			if err := f.Truncate(eventStart); err != nil {
+				self.logger.Error("truncate %s: %s", name, err.Error())
+			}
+		}
+		if err := f.Sync(); err != nil {
+			self.logger.Error("sync %s: %s", name, err.Error())
 		}
+		f.Close()
 	}()
 	defer util.RecoverToError(&err)
 
 	ib := 0
-	eventSize := uint32(0)
+	var checksum eventChecksum
+	pending := make(chan pendingAck, SEMISYNC_PENDING_ACKS)
+	ended, acksEnded := make(chan struct{}), make(chan struct{})
+	self.lock.RLock()
+	conn := self.client.Conn
+	self.lock.RUnlock()
+	go func() {
+		defer close(acksEnded)
+		self.sendSemisyncAcks(conn, pending, ended)
+	}()
+	defer func() {
+		close(ended)
+		close(pending)
+		<-acksEnded
+	}()
 	for task := range bufChanOut {
 		//self.logger.Info("got task %s:%d", task.name, task.pos)
 		if task.name != name { // file rotated!
-			self.logger.Info("writer rotated to " + task.name)
+			self.logger.Info("writer rotated to %s", task.name)
 			if f != nil {
+				// gtids retrieved are saved as those in synced binlogs
+				util.Assert0(f.Sync())
 				f.Close()
 			}
 			f = util.Assert1(self.getFileToWrite(task.name, task.pos)).(*os.File)
 			name = task.name
 		}
+		chunk := task.buffer[:task.size]
+		if eventSize == 0 {
+			eventStart = task.pos
+			checksum.Begin(chunk, task.checksum)
+		}
+		checksum.Received(chunk)
+		if eventSize == 0 && self.gtidMode {
+			// first chunk of an event, events are stored at local positions
+			rewriteLogPos(chunk, uint32(task.pos))
+		}
+		if eventSize == 0 && self.rewriteServerId != 0 {
+			rewriteServerId(chunk, self.rewriteServerId)
+		}
+		if err = checksum.Written(chunk); err != nil {
+			err = self.onChecksumError(f, name, eventStart)
+			eventSize = 0
+			return
+		}
 		//self.logger.Info("write at %d", task.pos)
-		_ = util.Assert1(f.WriteAt(task.buffer[:task.size], task.pos))
+		_ = util.Assert1(f.WriteAt(chunk, task.pos))
 		eventSize += task.size
-		if seq != task.seq { // next event
-			//self.logger.Info("append event %d", task.seq)
-			seq = task.seq
+		if task.eventEnd {
 			ib++
-			if ib >= self.syncBinlog {
+			if ib >= self.syncBinlog || task.ack {
 				//self.logger.Info("sync file")
+				begin := time.Now()
 				util.Assert0(f.Sync())
-				if self.semisync && task.ack {
-					go self.client.SendSemisyncAck(task.name, uint64(task.pos))
-				}
-				self.appendEvent(eventSize)
+				fsyncSeconds.With(self.name).Observe(time.Since(begin).Seconds())
 				ib = 0
 			}
+			if task.ack {
+				pending <- pendingAck{
+					local:    binlogPos{name: name, pos: uint64(task.pos) + uint64(task.size)},
+					upstream: binlogPos{name: task.ackName, pos: task.ackPos},
+				}
+			}
+			self.appendEvent(eventSize, &task)
+			eventsRelayed.With(self.name).Inc()
+			bytesRelayed.With(self.name).Add(uint64(eventSize))
+			if !task.commit.IsEmpty() {
+				self.addRetrievedGtid(task.commit)
+			}
 			eventSize = 0
 		}
 		bufChanIn <- task.buffer
@@ -243,12 +706,124 @@ func (self *BinlogRelay) writeBinlog(bufChanIn chan<- []byte, bufChanOut <-chan
 	return
 }
 
+// the event at pos is corrupted, chunks of it written are discarded.
+// returns the error ending the writer, which is the last error of the relay
+func (self *BinlogRelay) onChecksumError(f *os.File, name string, pos int64) error {
+	if err := f.Truncate(pos); err != nil {
+		self.logger.Error("truncate %s: %s", name, err.Error())
+	}
+	checksumMismatches.With(self.name).Inc()
+	if self.checksumErrorPolicy == CHECKSUM_ERROR_STOP {
+		// only this upstream stops, until started again by admin
+		self.logger.Error("checksum mismatch at %s:%d, upstream stopped", name, pos)
+		self.lock.Lock()
+		self.stopped = true
+		self.lock.Unlock()
+		return fmt.Errorf("%s at %s:%d, upstream stopped", CHECKSUM_MISMATCH.Error(), name, pos)
+	}
+	self.logger.Error("checksum mismatch at %s:%d, dump again", name, pos)
+	return CHECKSUM_MISMATCH
+}
+
+func rewriteLogPos(header []byte, pos uint32) {
+	eventSize := mysql.ENDIAN.Uint32(header[9:])
+	mysql.ENDIAN.PutUint32(header[13:], pos+eventSize)
+}
+
+func rewriteServerId(header []byte, serverId uint32) {
+	mysql.ENDIAN.PutUint32(header[5:], serverId)
+}
+
+func isBeginQuery(event *mysql.BinlogEventPacket, buffer []byte) bool {
+	if int(event.PacketLength) > len(buffer) {
+		return false // BEGIN is always small
+	}
+	var query mysql.QueryEvent
+	if query.Parse(event, buffer) != nil {
+		return false
+	}
+	return query.Query == "BEGIN"
+}
+
+func (self *BinlogRelay) nextLocalName(name string) string {
+	if name == "" {
+		return self.startFile
+	}
+	return util.Assert1(mysql.NextBinlogName(name)).(string)
+}
+
+func nextBuffer(bufChanIn <-chan []byte) []byte {
+	buffer, ok := <-bufChanIn
+	if !ok {
+		panic(WRITER_ENDED)
+	}
+	return buffer
+}
+
+// write an event generated by relay itself
+func (self *BinlogRelay) injectEvent(bufChanIn <-chan []byte, bufChanOut chan<- writeTask,
+	name string, pos uint32, header mysql.BinlogEventPacket, body mysql.Outputable, checksum bool) uint32 {
+	buffer := nextBuffer(bufChanIn)
+	n := mysql.BinlogEventHeaderSize
+	n += util.Assert1(body.ToBuffer(buffer[n:])).(int)
+	header.EventSize = uint32(n)
+	if checksum {
+		header.EventSize += 4
+	}
+	header.LogPos = pos + header.EventSize
+	_ = util.Assert1(header.HeaderToBuffer(buffer))
+	if checksum {
+		mysql.ENDIAN.PutUint32(buffer[n:], crc32.ChecksumIEEE(buffer[:n]))
+		n += 4
+	}
+	task := writeTask{
+		name:      name,
+		buffer:    buffer,
+		size:      uint32(n),
+		pos:       int64(pos),
+		eventEnd:  true,
+		checksum:  checksum,
+		eventType: header.EventType,
+	}
+	if previousGtids, ok := body.(*mysql.PreviousGtidsEvent); ok {
+		task.previousGtids = previousGtids.Gtids.Clone()
+	}
+	bufChanOut <- task
+	return header.EventSize
+}
+
+// in gtid mode, the last local binlog is ended when a reconnection begins a new one.
+// it is cut after the last transaction committed, which upstream sends again, and rotates to the new one.
+// returns false if it has no event, to be written again instead
+func (self *BinlogRelay) endLocalBinlog(bufChanIn <-chan []byte, bufChanOut chan<- writeTask, serverId uint32) bool {
+	index, _ := self.CurrentPosition()
+	entry := self.BinlogInfoByIndex(index)
+	tail := util.Assert1(self.scanBinlogTail(&entry)).(binlogTail)
+	if tail.end <= mysql.LOG_POS_START {
+		return false
+	}
+	if tail.end < entry.Size {
+		self.logger.Warn("transaction not committed at %s:%d, truncate %d bytes", entry.Name, tail.end, entry.Size-tail.end)
+		util.Assert0(self.truncateBinlog(index, tail.end))
+	}
+	if !tail.rotated {
+		header := mysql.BinlogEventPacket{
+			Timestamp: uint32(time.Now().Unix()),
+			EventType: mysql.ROTATE_EVENT,
+			ServerId:  serverId,
+		}
+		next := mysql.RotateEvent{Name: self.nextLocalName(entry.Name), Position: mysql.LOG_POS_START}
+		self.injectEvent(bufChanIn, bufChanOut, entry.Name, tail.end, header, &next, tail.checksum)
+	}
+	return true
+}
+
 func (self *BinlogRelay) dumpBinlog(bufChanIn <-chan []byte, bufChanOut chan<- writeTask) (err error) {
 	defer func() {
 		close(bufChanOut)
 		self.logger.Info("dumper ended")
 		if err != nil {
-			self.logger.Error("dumper: " + err.Error())
+			self.logger.Error("dumper: %s", err.Error())
 		}
 	}()
 	defer util.RecoverToError(&err)
@@ -256,37 +831,123 @@ func (self *BinlogRelay) dumpBinlog(bufChanIn <-chan []byte, bufChanOut chan<- w
 	if self.startPos < mysql.LOG_POS_START {
 		self.startPos = mysql.LOG_POS_START
 	}
-	stream := util.Assert1(self.client.DumpBinlog(mysql.ComBinglogDump{
-		BinlogFilename: self.startFile,
-		BinlogPos:      self.startPos,
-		ServerId:       self.client.ServerId,
-	}, self.semisync, self.heartbeatPeriod)).(*mysql.BinlogEventStream)
-	self.semisync = stream.IsSemisync()
+	self.queryUpstreamGtidMode()
+	self.client.MasterBinlogChecksum = "NONE"
+	if self.negotiateChecksum {
+		self.client.MasterBinlogChecksum = self.queryUpstreamChecksum()
+	}
+	self.logger.Info("dump with binlog checksum %s", self.client.MasterBinlogChecksum)
+	var stream *mysql.BinlogEventStream
 	filename := self.startFile
-	hasBinlogChecksum := false
+	resumed := false // a local binlog is left by the last run, in gtid mode
+	if self.gtidMode {
+		retrieved := self.RetrievedGtids()
+		self.logger.Info("dumper start with gtid set: %s", retrieved.String())
+		stream = util.Assert1(self.client.DumpBinlogGtid(mysql.ComBinlogDumpGtid{
+			Flags:     mysql.BINLOG_THROUGH_GTID,
+			ServerId:  self.client.ServerId,
+			BinlogPos: mysql.LOG_POS_START,
+			Gtids:     retrieved,
+		}, self.semisync, uint64(self.heartbeatPeriod))).(*mysql.BinlogEventStream)
+		if len(self.fileIndex) == 0 {
+			filename = ""
+		}
+		resumed = filename != ""
+	} else {
+		stream = util.Assert1(self.client.DumpBinlog(mysql.ComBinglogDump{
+			BinlogFilename: self.startFile,
+			BinlogPos:      self.startPos,
+			ServerId:       self.client.ServerId,
+		}, self.semisync, uint64(self.heartbeatPeriod))).(*mysql.BinlogEventStream)
+	}
+	self.onDumpStarted(stream.IsSemisync())
+	upstreamFilename := self.startFile
+	// events before the first FORMAT_DESCRIPTION_EVENT are checksummed as negotiated
+	hasBinlogChecksum := self.client.MasterBinlogChecksum == "CRC32"
 	curPos := self.startPos
+	var pendingGtid mysql.Gtid // gtid of the transaction being received
+	gtids := self.RetrievedGtids()
 
 	self.logger.Info("dumper start at %s:%d", filename, curPos)
 
 	for event := stream.Next(); event != nil; event = stream.Next() {
 		event.HasChecksum = hasBinlogChecksum
-		self.logger.Info(fmt.Sprintf("event: { %s }", event.String()))
+		self.logger.Info("event: { %s }", event.String())
+		self.onEventReceived(event, upstreamFilename)
+		var rotate *mysql.RotateEvent
+		var commit, gtid mysql.Gtid
+		var previousGtids mysql.GtidSet
 		switch event.EventType {
 		case mysql.FORMAT_DESCRIPTION_EVENT:
 			var formatDescription mysql.FormatDescriptionEvent
 			formatDescription.Parse(event, self.client.Buffer[:])
-			hasBinlogChecksum = (formatDescription.ChecksumAlgorism == 1)
+			hasBinlogChecksum = (formatDescription.ChecksumAlgorism == mysql.BINLOG_CHECKSUM_ALG_CRC32)
+			self.setBinlogChecksum(hasBinlogChecksum)
+			if self.gtidMode {
+				// every upstream binlog and every reconnection begins a new local binlog
+				if !resumed || self.endLocalBinlog(bufChanIn, bufChanOut, event.ServerId) {
+					filename = self.nextLocalName(filename)
+				}
+				resumed = false
+				curPos = mysql.LOG_POS_START
+				self.logger.Info("local binlog: %s", filename)
+			}
 
 		case mysql.ROTATE_EVENT:
-			// change to next file!
-			var rotate mysql.RotateEvent
+			rotate = new(mysql.RotateEvent)
 			util.Assert0(rotate.Parse(event, self.client.Buffer[:]))
-			filename = rotate.Name
-			curPos = uint32(rotate.Position)
-			self.logger.Info("rotate event: %s:%d", filename, curPos)
+			upstreamFilename = rotate.Name
+			self.onRotateReceived(rotate)
+			self.logger.Info("rotate event: %s:%d", rotate.Name, rotate.Position)
+			if self.gtidMode {
+				if !event.IsFake() {
+					// point to next local binlog instead
+					header := mysql.BinlogEventPacket{
+						Timestamp: uint32(time.Now().Unix()),
+						EventType: mysql.ROTATE_EVENT,
+						ServerId:  event.ServerId,
+					}
+					next := mysql.RotateEvent{Name: self.nextLocalName(filename), Position: mysql.LOG_POS_START}
+					curPos += self.injectEvent(bufChanIn, bufChanOut, filename, curPos, header, &next, hasBinlogChecksum)
+				}
+				continue
+			}
+			if event.IsFake() {
+				filename = rotate.Name
+				curPos = uint32(rotate.Position)
+			}
+
+		case mysql.HEARTBEAT_EVENT:
+			continue
+
+		case mysql.PREVIOUS_GTIDS_EVENT:
+			if self.gtidMode {
+				continue // replaced by the one of relay
+			}
+			if int(event.PacketLength) <= len(self.client.Buffer) {
+				var previousGtidsEvent mysql.PreviousGtidsEvent
+				util.Assert0(previousGtidsEvent.Parse(event, self.client.Buffer[:]))
+				previousGtids = previousGtidsEvent.Gtids
+			} else {
+				self.logger.Warn("PREVIOUS_GTIDS_EVENT too large to index")
+			}
+
+		case mysql.GTID_EVENT:
+			var gtidEvent mysql.GtidEvent
+			util.Assert0(gtidEvent.Parse(event, self.client.Buffer[:]))
+			pendingGtid = gtidEvent.Gtid
+			gtid = gtidEvent.Gtid
+
+		case mysql.XID_EVENT:
+			commit, pendingGtid = pendingGtid, mysql.Gtid{}
+
+		case mysql.QUERY_EVENT:
+			if !pendingGtid.IsEmpty() && !isBeginQuery(event, self.client.Buffer[:]) {
+				commit, pendingGtid = pendingGtid, mysql.Gtid{}
+			}
 		}
 
-		if event.IsFake() {
+		if event.IsFake() && !(self.gtidMode && event.EventType == mysql.FORMAT_DESCRIPTION_EVENT) {
 			continue
 		}
 
@@ -299,18 +960,28 @@ func (self *BinlogRelay) dumpBinlog(bufChanIn <-chan []byte, bufChanOut chan<- w
 		}
 		n := 0
 		for {
-			buffer := <-bufChanIn
+			buffer := nextBuffer(bufChanIn)
 			n, err = reader.Read(buffer)
-			if n > 0 {
+			if n > 0 || err == io.EOF {
 				//self.logger.Info("writeTask: {name:%s, pos:%d, size:%d, bufsize:%d}", filename, curPos, n, len(buffer))
-				bufChanOut <- writeTask{
-					name:   filename,
-					buffer: buffer,
-					size:   uint32(n),
-					seq:    event.PacketSeq,
-					pos:    int64(curPos),
-					ack:    event.Semisync == mysql.SEMISYNC_ACK,
+				task := writeTask{
+					name:     filename,
+					buffer:   buffer,
+					size:     uint32(n),
+					pos:      int64(curPos),
+					eventEnd: err == io.EOF,
+					checksum: hasBinlogChecksum,
+				}
+				if task.eventEnd {
+					task.ack = event.Semisync == mysql.SEMISYNC_ACK
+					task.ackName = upstreamFilename
+					task.ackPos = uint64(event.LogPos)
+					task.commit = commit
+					task.eventType = event.EventType
+					task.gtid = gtid
+					task.previousGtids = previousGtids
 				}
+				bufChanOut <- task
 				curPos += uint32(n)
 			}
 			if err == io.EOF {
@@ -318,11 +989,39 @@ func (self *BinlogRelay) dumpBinlog(bufChanIn <-chan []byte, bufChanOut chan<- w
 			}
 			util.Assert0(err)
 		}
+
+		if !commit.IsEmpty() {
+			gtids.Add(commit)
+		}
+		if rotate != nil {
+			filename = rotate.Name
+			curPos = uint32(rotate.Position)
+		}
+		if self.gtidMode && event.EventType == mysql.FORMAT_DESCRIPTION_EVENT {
+			header := mysql.BinlogEventPacket{
+				Timestamp: event.Timestamp,
+				EventType: mysql.PREVIOUS_GTIDS_EVENT,
+				ServerId:  event.ServerId,
+			}
+			previousGtids := mysql.PreviousGtidsEvent{Gtids: gtids}
+			curPos += self.injectEvent(bufChanIn, bufChanOut, filename, curPos, header, &previousGtids, hasBinlogChecksum)
+		}
 	}
 	err = stream.GetError()
 	return
 }
 
+// the next run continues after the last event written, in the last binlog
+func (self *BinlogRelay) resumePosition() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.stopped = false
+	if len(self.fileIndex) > 0 {
+		entry := &self.fileIndex[self.curFileId]
+		self.startFile, self.startPos = entry.Name, entry.Size
+	}
+}
+
 func (self *BinlogRelay) Run() error {
 	nBuffers := 4
 	bufChanIn := make(chan []byte, nBuffers)
@@ -332,8 +1031,15 @@ func (self *BinlogRelay) Run() error {
 	for i := 0; i < nBuffers; i++ {
 		bufChanIn <- self.buf[i*sz : i*sz+sz]
 	}
-	return util.Barrier{
+	self.resumePosition()
+	self.setRunning(true)
+	err := util.Barrier{
 		func() error { return self.dumpBinlog(bufChanIn, bufChanOut) },
 		func() error { return self.writeBinlog(bufChanIn, bufChanOut) },
 	}.Run()
+	self.setRunning(false)
+	if err != nil {
+		self.SetLastError(err)
+	}
+	return err
 }
@@ -0,0 +1,145 @@
+package relay
+
+import (
+	"io"
+	"io/ioutil"
+	"mysql_relay/mysql"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestPositionChanged(t *testing.T) {
+	var relay BinlogRelay
+	relay.appendIndex("log-bin.000001")
+	index, pos := relay.CurrentPosition()
+	select {
+	case <-relay.PositionChanged(index, pos-1):
+	default:
+		t.Error("not closed after moved")
+	}
+	changed := relay.PositionChanged(index, pos)
+	select {
+	case <-changed:
+		t.Fatal("closed before moved")
+	default:
+	}
+	go relay.appendEvent(100, &writeTask{})
+	select {
+	case <-changed:
+	case <-time.After(time.Second):
+		t.Fatal("not woken up by new event")
+	}
+	if index, pos = relay.CurrentPosition(); pos != 104 {
+		t.Errorf("position %d:%d", index, pos)
+	}
+}
+
+// a binlog of transactions of sid from gno 1 to n, the last one is not committed if torn
+func buildTestGtidBinlog(sid mysql.Sid, n int, torn bool) []byte {
+	binlog := buildTestBinlog(0)
+	appendEvent := func(eventType byte, body []byte) {
+		binlog = append(binlog, buildTestBinlogEvent(eventType, uint32(len(binlog)), body)...)
+	}
+	previous := make([]byte, mysql.NewGtidSet().EncodedLength())
+	mysql.NewGtidSet().ToBuffer(previous)
+	appendEvent(mysql.PREVIOUS_GTIDS_EVENT, previous)
+	for gno := 1; gno <= n; gno++ {
+		gtid := make([]byte, 25)
+		copy(gtid[1:], sid[:])
+		mysql.ENDIAN.PutUint64(gtid[17:], uint64(gno))
+		appendEvent(mysql.GTID_EVENT, gtid)
+		appendEvent(mysql.QUERY_EVENT, append(make([]byte, 14), "BEGIN"...))
+		if gno < n || !torn {
+			appendEvent(mysql.XID_EVENT, make([]byte, 8))
+		}
+	}
+	return binlog
+}
+
+func TestLoadRetrievedGtids(t *testing.T) {
+	dir, err := ioutil.TempDir("", "relay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	relay := BinlogRelay{localDir: dir, startFile: "log-bin.000001"}
+	sid, _ := mysql.ParseSid("3e11fa47-71ca-11e1-9e33-c80aa9429562")
+	if err = ioutil.WriteFile(relay.NameToPath("log-bin.000001"), buildTestGtidBinlog(sid, 4, true), 0664); err != nil {
+		t.Fatal(err)
+	}
+	// saved before the binlog was created
+	saved := "4b4c9fb1-71ca-11e1-9e33-c80aa9429562:1-3"
+	if err = ioutil.WriteFile(relay.NameToPath(GTID_STATE_FILE), []byte(saved), 0664); err != nil {
+		t.Fatal(err)
+	}
+	if err = relay.ReloadPos(); err != nil {
+		t.Fatal(err)
+	}
+	if err = relay.loadRetrievedGtids(); err != nil {
+		t.Fatal(err)
+	}
+	expected, _ := mysql.ParseGtidSet(saved + ",3e11fa47-71ca-11e1-9e33-c80aa9429562:1-3")
+	if !relay.RetrievedGtids().Equals(expected) {
+		t.Errorf("retrieved %s", relay.RetrievedGtids().String())
+	}
+}
+
+func TestEndLocalBinlog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "relay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	relay := BinlogRelay{localDir: dir, startFile: "log-bin.000001", syncBinlog: 1, gtidMode: true}
+	relay.acker.Init()
+	sid, _ := mysql.ParseSid("3e11fa47-71ca-11e1-9e33-c80aa9429562")
+	committed := buildTestGtidBinlog(sid, 3, false)
+	torn := buildTestGtidBinlog(sid, 4, true)
+	if err = ioutil.WriteFile(relay.NameToPath("log-bin.000001"), torn, 0664); err != nil {
+		t.Fatal(err)
+	}
+	if err = relay.ReloadPos(); err != nil {
+		t.Fatal(err)
+	}
+
+	bufChanIn := make(chan []byte, 1)
+	bufChanIn <- make([]byte, 1024)
+	bufChanOut := make(chan writeTask)
+	ended := make(chan error)
+	go func() { ended <- relay.writeBinlog(bufChanIn, bufChanOut) }()
+	if !relay.endLocalBinlog(bufChanIn, bufChanOut, 1) {
+		t.Fatal("binlog not ended")
+	}
+	close(bufChanOut)
+	if err = <-ended; err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := OpenBinlogReader(relay.NameToPath("log-bin.000001"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	reader.Verify = true
+	if err = reader.Seek(uint32(len(committed))); err != nil {
+		t.Fatal(err)
+	}
+	event, err := reader.Next()
+	if err != nil || event.EventType != mysql.ROTATE_EVENT {
+		t.Fatalf("got %s, %v after the last transaction committed", event.String(), err)
+	}
+	var rotate mysql.RotateEvent
+	if err = reader.LoadBody(&event); err == nil {
+		err = rotate.Parse(&event, reader.Buffer)
+	}
+	if err != nil || rotate.Name != "log-bin.000002" {
+		t.Errorf("rotate to %s, %v", rotate.Name, err)
+	}
+	if _, err = reader.Next(); err != io.EOF {
+		t.Errorf("not ended after rotate: %v", err)
+	}
+	if _, pos := relay.CurrentPosition(); pos != reader.Size() {
+		t.Errorf("indexed to %d of %d", pos, reader.Size())
+	}
+}
@@ -0,0 +1,155 @@
+package relay
+
+import (
+	"mysql_relay/mysql"
+	"net"
+	"sync"
+	"time"
+)
+
+const SEMISYNC_PENDING_ACKS = 4096
+
+type binlogPos struct {
+	name string
+	pos  uint64
+}
+
+// compares binlog names by number, as names of a relay share the prefix
+func (self binlogPos) Before(other binlogPos) bool {
+	if self.name != other.name {
+		_, n1, err1 := mysql.ParseBinlogName(self.name)
+		_, n2, err2 := mysql.ParseBinlogName(other.name)
+		if err1 != nil || err2 != nil {
+			return self.name < other.name
+		}
+		return n1 < n2
+	}
+	return self.pos < other.pos
+}
+
+// an event written and synced, to be acked to upstream
+type pendingAck struct {
+	local    binlogPos
+	upstream binlogPos
+}
+
+// acks upstream after a quorum of downstream replicas have acked the same event.
+// after timeout, upstream is acked as soon as events are synced until the quorum catches up
+type semisyncAcker struct {
+	quorum  int
+	timeout time.Duration
+
+	lock       sync.Mutex
+	downstream map[uint32]binlogPos // acked positions by server id of replicas
+	degraded   bool                 // only accessed by the goroutine sending acks
+	notify     chan struct{}
+}
+
+func (self *semisyncAcker) Init() {
+	self.downstream = make(map[uint32]binlogPos)
+	self.notify = make(chan struct{}, 1)
+}
+
+func (self *semisyncAcker) Ack(serverId uint32, pos binlogPos) {
+	self.lock.Lock()
+	if last, ok := self.downstream[serverId]; !ok || last.Before(pos) {
+		self.downstream[serverId] = pos
+	}
+	self.lock.Unlock()
+	select {
+	case self.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (self *semisyncAcker) Remove(serverId uint32) {
+	self.lock.Lock()
+	delete(self.downstream, serverId)
+	self.lock.Unlock()
+}
+
+func (self *semisyncAcker) acked(pos binlogPos) bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	n := 0
+	for _, acked := range self.downstream {
+		if !acked.Before(pos) {
+			n++
+		}
+	}
+	return n >= self.quorum
+}
+
+// wait for the quorum, returns false on timeout or once canceled
+func (self *semisyncAcker) wait(pos binlogPos, cancel <-chan struct{}) bool {
+	if self.quorum <= 0 {
+		return true
+	}
+	if self.acked(pos) {
+		self.degraded = false
+		return true
+	}
+	if self.degraded {
+		return false
+	}
+	timer := time.NewTimer(self.timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case <-self.notify:
+			if self.acked(pos) {
+				return true
+			}
+		case <-timer.C:
+			self.degraded = true
+			return false
+		case <-cancel:
+			return false
+		}
+	}
+}
+
+// 0 to ack upstream once events are synced, not waiting for replicas
+func (self *BinlogRelay) SetSemisyncQuorum(quorum int, timeout time.Duration) {
+	self.acker.quorum = quorum
+	self.acker.timeout = timeout
+}
+
+// acks are sent in order by a single goroutine, on the connection the writer began with.
+// acks pending once the writer has ended are dropped with the connection
+func (self *BinlogRelay) sendSemisyncAcks(conn net.Conn, pending <-chan pendingAck, ended <-chan struct{}) {
+	client := mysql.Client{Conn: conn}
+	for ack := range pending {
+		degraded := self.acker.degraded
+		acked := self.acker.wait(ack.local, ended)
+		select {
+		case <-ended:
+			return
+		default:
+		}
+		if !acked && !degraded {
+			semisyncAckTimeouts.With(self.name).Inc()
+			self.logger.Warn("timeout waiting %d replicas to ack %s:%d, ack without them",
+				self.acker.quorum, ack.local.name, ack.local.pos)
+		} else if degraded && !self.acker.degraded {
+			self.logger.Info("%d replicas acked %s:%d, wait for them again",
+				self.acker.quorum, ack.local.name, ack.local.pos)
+		}
+		if err := client.SendSemisyncAck(ack.upstream.name, ack.upstream.pos); err != nil {
+			self.logger.Error("semisync ack: %s", err.Error())
+		} else {
+			semisyncAcksSent.With(self.name).Inc()
+		}
+	}
+}
+
+// a semisync replica acked the event ending at pos of local binlog
+func (self *BinlogRelay) AckDownstream(serverId uint32, name string, pos uint64) {
+	semisyncAcksReceived.With(self.name).Inc()
+	self.acker.Ack(serverId, binlogPos{name: name, pos: pos})
+}
+
+// the replica no longer acks
+func (self *BinlogRelay) RemoveDownstream(serverId uint32) {
+	self.acker.Remove(serverId)
+}
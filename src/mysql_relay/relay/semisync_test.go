@@ -0,0 +1,91 @@
+package relay
+
+import (
+	"io/ioutil"
+	"mysql_relay/mysql"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestBinlogPosBefore(t *testing.T) {
+	if !(binlogPos{"log-bin.999999", 100}).Before(binlogPos{"log-bin.1000000", 4}) {
+		t.Error("binlog names should be compared by number")
+	}
+	if !(binlogPos{"log-bin.000001", 4}).Before(binlogPos{"log-bin.000001", 100}) {
+		t.Error("positions in a binlog should be compared")
+	}
+	if (binlogPos{"log-bin.000001", 100}).Before(binlogPos{"log-bin.000001", 100}) {
+		t.Error("a position should not be before itself")
+	}
+}
+
+func TestSemisyncAckerQuorum(t *testing.T) {
+	var acker semisyncAcker
+	acker.Init()
+	acker.quorum = 2
+	acker.timeout = time.Second
+	pos := binlogPos{"log-bin.000002", 1000}
+
+	acker.Ack(1, binlogPos{"log-bin.000003", 4})
+	acker.Ack(2, binlogPos{"log-bin.000002", 500})
+	if acker.acked(pos) {
+		t.Fatal("acked by 1 of 2 replicas")
+	}
+	go acker.Ack(2, pos)
+	if !acker.wait(pos, nil) {
+		t.Fatal("timeout with quorum acked")
+	}
+
+	acker.Remove(1)
+	acker.timeout = 10 * time.Millisecond
+	next := binlogPos{"log-bin.000003", 100}
+	if acker.wait(next, nil) || !acker.degraded {
+		t.Fatal("quorum should time out")
+	}
+	// not waiting again until replicas catch up
+	begin := time.Now()
+	if acker.wait(binlogPos{"log-bin.000003", 200}, nil) || time.Since(begin) >= acker.timeout {
+		t.Fatal("should not wait when degraded")
+	}
+	acker.Ack(1, binlogPos{"log-bin.000003", 300})
+	acker.Ack(2, binlogPos{"log-bin.000003", 300})
+	if !acker.wait(binlogPos{"log-bin.000003", 300}, nil) || acker.degraded {
+		t.Fatal("quorum should be restored")
+	}
+}
+
+func TestWriterEndsWithoutWaitingAcks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "relay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	relay := BinlogRelay{localDir: dir, syncBinlog: 1}
+	relay.acker.Init()
+	relay.SetSemisyncQuorum(1, time.Minute)
+
+	event := buildTestBinlogEvent(mysql.XID_EVENT, mysql.LOG_POS_START, make([]byte, 8))
+	bufChanIn := make(chan []byte, 1)
+	bufChanOut := make(chan writeTask, 1)
+	bufChanOut <- writeTask{
+		name:     "log-bin.000001",
+		buffer:   event,
+		size:     uint32(len(event)),
+		pos:      mysql.LOG_POS_START,
+		eventEnd: true,
+		ack:      true,
+		checksum: true,
+	}
+	close(bufChanOut)
+	ended := make(chan error, 1)
+	go func() { ended <- relay.writeBinlog(bufChanIn, bufChanOut) }()
+	select {
+	case err = <-ended:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("writer waiting for replicas to ack after ended")
+	}
+}
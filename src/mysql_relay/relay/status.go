@@ -0,0 +1,142 @@
+package relay
+
+import (
+	"mysql_relay/mysql"
+	"time"
+)
+
+// state of dumping the upstream, as SHOW SLAVE STATUS
+type RelayStatus struct {
+	Running    bool
+	Connecting bool
+	MasterAddr string
+	Semisync   bool
+
+	MasterLogFile    string // upstream binlog of the last event received
+	ReadMasterLogPos uint64
+	RelayLogFile     string // local binlog written
+	RelayLogPos      uint32
+	RelayLogSpace    uint64
+
+	// seconds from the last event written on upstream to received by relay, 0 after heartbeats, -1 if unknown
+	SecondsBehindMaster int64
+	RetrievedGtids      mysql.GtidSet
+
+	LastError     string
+	LastErrorTime time.Time
+}
+
+// received by the dumper, guarded by lock
+type dumpStatus struct {
+	running       bool
+	connecting    bool
+	semisync      bool // accepted by upstream
+	masterLogFile string
+	masterLogPos  uint64
+	behind        int64
+	lastError     string
+	lastErrorTime time.Time
+}
+
+func (self *BinlogRelay) Status() (status RelayStatus) {
+	self.lock.RLock()
+	status = RelayStatus{
+		Running:             self.status.running,
+		Connecting:          self.status.connecting,
+		MasterAddr:          self.client.ServerAddr,
+		Semisync:            self.status.semisync && self.status.running,
+		MasterLogFile:       self.status.masterLogFile,
+		ReadMasterLogPos:    self.status.masterLogPos,
+		SecondsBehindMaster: self.status.behind,
+		RetrievedGtids:      self.retrievedGtids.Clone(),
+		LastError:           self.status.lastError,
+		LastErrorTime:       self.status.lastErrorTime,
+	}
+	for _, entry := range self.fileIndex {
+		if !entry.purged {
+			status.RelayLogSpace += uint64(entry.Size)
+		}
+	}
+	if len(self.fileIndex) > 0 {
+		status.RelayLogFile = self.fileIndex[self.curFileId].Name
+		status.RelayLogPos = self.fileIndex[self.curFileId].Size
+	}
+	self.lock.RUnlock()
+	if !status.Running {
+		status.SecondsBehindMaster = -1
+	}
+	return
+}
+
+// close the connection to upstream, the relay ends
+func (self *BinlogRelay) Disconnect() {
+	self.lock.RLock()
+	conn := self.client.Conn
+	self.lock.RUnlock()
+	if conn != nil {
+		conn.Close()
+	}
+}
+
+// whether dumping upstream
+func (self *BinlogRelay) Running() bool {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	return self.status.running
+}
+
+// connecting to upstream before the relay runs again
+func (self *BinlogRelay) SetConnecting(b bool) {
+	self.lock.Lock()
+	self.status.connecting = b
+	self.lock.Unlock()
+}
+
+func (self *BinlogRelay) SetLastError(err error) {
+	self.lock.Lock()
+	self.status.lastError = err.Error()
+	self.status.lastErrorTime = time.Now()
+	self.lock.Unlock()
+}
+
+func (self *BinlogRelay) onDumpStarted(semisync bool) {
+	self.lock.Lock()
+	self.status.semisync = semisync
+	self.lock.Unlock()
+}
+
+func (self *BinlogRelay) setRunning(b bool) {
+	self.lock.Lock()
+	self.status.running = b
+	self.status.behind = -1
+	if b {
+		self.status.connecting = false
+	}
+	self.lock.Unlock()
+}
+
+// an event received from upstream at its file
+func (self *BinlogRelay) onEventReceived(event *mysql.BinlogEventPacket, masterLogFile string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.status.masterLogFile = masterLogFile
+	if event.LogPos > 0 {
+		self.status.masterLogPos = uint64(event.LogPos)
+	}
+	if event.EventType == mysql.HEARTBEAT_EVENT {
+		// nothing more to send
+		self.status.behind = 0
+	} else if !event.IsFake() && event.Timestamp > 0 {
+		self.status.behind = time.Now().Unix() - int64(event.Timestamp)
+		if self.status.behind < 0 {
+			self.status.behind = 0
+		}
+	}
+}
+
+func (self *BinlogRelay) onRotateReceived(rotate *mysql.RotateEvent) {
+	self.lock.Lock()
+	self.status.masterLogFile = rotate.Name
+	self.status.masterLogPos = rotate.Position
+	self.lock.Unlock()
+}
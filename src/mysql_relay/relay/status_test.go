@@ -0,0 +1,27 @@
+package relay
+
+import (
+	"mysql_relay/mysql"
+	"testing"
+	"time"
+)
+
+func TestRelayStatusBehindMaster(t *testing.T) {
+	var relay BinlogRelay
+	relay.retrievedGtids = mysql.NewGtidSet()
+	if status := relay.Status(); status.SecondsBehindMaster != -1 {
+		t.Errorf("behind %d while not running", status.SecondsBehindMaster)
+	}
+	relay.setRunning(true)
+	event := mysql.BinlogEventPacket{EventType: mysql.XID_EVENT, LogPos: 1000, Timestamp: uint32(time.Now().Unix()) - 60}
+	relay.onEventReceived(&event, "mysql-bin.000002")
+	status := relay.Status()
+	if status.SecondsBehindMaster < 60 || status.MasterLogFile != "mysql-bin.000002" || status.ReadMasterLogPos != 1000 {
+		t.Errorf("status: %+v", status)
+	}
+	heartbeat := mysql.BinlogEventPacket{EventType: mysql.HEARTBEAT_EVENT, LogPos: 1200}
+	relay.onEventReceived(&heartbeat, "mysql-bin.000002")
+	if status = relay.Status(); status.SecondsBehindMaster != 0 || status.ReadMasterLogPos != 1200 {
+		t.Errorf("status after heartbeat: %+v", status)
+	}
+}
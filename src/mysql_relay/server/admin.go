@@ -0,0 +1,222 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type AdminBinlog struct {
+	Name string
+	Size uint32
+}
+
+type AdminUpstream struct {
+	Name                string
+	State               string // "running", "connecting" or "stopped"
+	Retries             uint32
+	MasterAddr          string
+	MasterLogFile       string
+	ReadMasterLogPos    uint64
+	RelayLogFile        string
+	RelayLogPos         uint32
+	SecondsBehindMaster int64
+	Semisync            bool
+	RetrievedGtids      string
+	LastError           string
+	LastErrorTime       *time.Time `json:",omitempty"`
+	Binlogs             []AdminBinlog
+}
+
+type AdminPeer struct {
+	ConnId     uint32
+	User       string
+	Upstream   string
+	RemoteAddr string
+	ServerId   uint32
+	Binlog     string
+	Pos        uint32
+	LagBytes   int64 // -1 if not dumping
+	Semisync   bool
+}
+
+// serve the admin api of json over http, Server.AdminAddr
+func (self *Server) serveAdmin() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/upstreams", self.onAdminUpstreams)
+	mux.HandleFunc("/upstreams/", self.onAdminUpstream)
+	mux.HandleFunc("/peers", self.onAdminPeers)
+	mux.HandleFunc("/peers/", self.onAdminPeer)
+	mux.HandleFunc("/metrics", self.onMetrics)
+	fmt.Printf("admin listening %s\n", self.Config.Server.AdminAddr)
+	if self.Config.Server.AdminToken == "" {
+		fmt.Printf("admin: no AdminToken, stop, start and kill are open to whoever reaches %s\n", self.Config.Server.AdminAddr)
+	}
+	if err := http.ListenAndServe(self.Config.Server.AdminAddr, mux); err != nil {
+		fmt.Printf("admin: %s\n", err.Error())
+	}
+}
+
+func writeJson(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeJsonError(w http.ResponseWriter, status int, message string) {
+	writeJson(w, status, map[string]string{"Error": message})
+}
+
+// POST actions require Server.AdminToken as a bearer token if it is set
+func (self *Server) authorizeAdmin(w http.ResponseWriter, r *http.Request) bool {
+	token := self.Config.Server.AdminToken
+	if r.Method != "POST" || token == "" ||
+		subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) == 1 {
+		return true
+	}
+	writeJsonError(w, http.StatusUnauthorized, "unauthorized")
+	return false
+}
+
+func (self *Server) adminUpstream(name string) AdminUpstream {
+	upstream := AdminUpstream{Name: name, State: "stopped", SecondsBehindMaster: -1, Binlogs: []AdminBinlog{}}
+	if control, ok := self.controls[name]; ok {
+		upstream.Retries = control.Retries()
+	}
+	status := self.upstreamStatus(name)
+	if status.Running {
+		upstream.State = "running"
+	} else if status.Connecting {
+		upstream.State = "connecting"
+	}
+	upstream.MasterAddr = status.MasterAddr
+	upstream.MasterLogFile = status.MasterLogFile
+	upstream.ReadMasterLogPos = status.ReadMasterLogPos
+	upstream.RelayLogFile = status.RelayLogFile
+	upstream.RelayLogPos = status.RelayLogPos
+	upstream.SecondsBehindMaster = status.SecondsBehindMaster
+	upstream.Semisync = status.Semisync
+	if status.RetrievedGtids != nil {
+		upstream.RetrievedGtids = status.RetrievedGtids.String()
+	}
+	upstream.LastError = status.LastError
+	if status.LastError != "" {
+		upstream.LastErrorTime = &status.LastErrorTime
+	}
+	if relay := self.GetUpstream(name); relay != nil {
+		for _, binlog := range relay.ListBinlogs() {
+			upstream.Binlogs = append(upstream.Binlogs, AdminBinlog{Name: binlog.Name, Size: binlog.Size})
+		}
+	}
+	return upstream
+}
+
+func (self *Server) adminPeer(peer *Peer) AdminPeer {
+	info := AdminPeer{
+		ConnId:     peer.ConnId,
+		User:       peer.User,
+		Upstream:   self.Config.Users[peer.User].Upstream,
+		RemoteAddr: peer.RemoteAddr().String(),
+		ServerId:   peer.ClientServerId,
+		LagBytes:   -1,
+	}
+	peer.stateLock.Lock()
+	info.Semisync = peer.semisync
+	peer.stateLock.Unlock()
+	info.Binlog, info.Pos = peer.SendingPosition()
+	if relay := peer.GetRelay(); relay != nil && info.Binlog != "" {
+		info.LagBytes = relay.BytesBehind(info.Binlog, info.Pos)
+	}
+	return info
+}
+
+// GET /upstreams
+func (self *Server) onAdminUpstreams(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeJsonError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	upstreams := make([]AdminUpstream, 0, len(self.Config.Upstreams))
+	for _, name := range self.UpstreamNames() {
+		upstreams = append(upstreams, self.adminUpstream(name))
+	}
+	writeJson(w, http.StatusOK, upstreams)
+}
+
+// GET /upstreams/<name>, POST /upstreams/<name>/stop or /upstreams/<name>/start
+func (self *Server) onAdminUpstream(w http.ResponseWriter, r *http.Request) {
+	if !self.authorizeAdmin(w, r) {
+		return
+	}
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/upstreams/"), "/")
+	name := parts[0]
+	if _, ok := self.Config.Upstreams[name]; !ok {
+		writeJsonError(w, http.StatusNotFound, "no upstream "+name)
+		return
+	}
+	var err error
+	switch {
+	case len(parts) == 1 && r.Method == "GET":
+	case len(parts) == 2 && parts[1] == "stop" && r.Method == "POST":
+		err = self.StopUpstream(name)
+	case len(parts) == 2 && parts[1] == "start" && r.Method == "POST":
+		err = self.StartUpstream(name)
+	default:
+		writeJsonError(w, http.StatusNotFound, "not found")
+		return
+	}
+	if err != nil {
+		writeJsonError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJson(w, http.StatusOK, self.adminUpstream(name))
+}
+
+// GET /peers
+func (self *Server) onAdminPeers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeJsonError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	peers := make([]AdminPeer, 0, 16)
+	for _, peer := range self.PeerList() {
+		if peer.User != "" {
+			peers = append(peers, self.adminPeer(peer))
+		}
+	}
+	writeJson(w, http.StatusOK, peers)
+}
+
+// GET /peers/<conn id>, POST /peers/<conn id>/kill
+func (self *Server) onAdminPeer(w http.ResponseWriter, r *http.Request) {
+	if !self.authorizeAdmin(w, r) {
+		return
+	}
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/peers/"), "/")
+	connId, err := strconv.ParseUint(parts[0], 10, 32)
+	var peer *Peer
+	if err == nil {
+		self.peersLock.RLock()
+		peer = self.Peers[uint32(connId)]
+		self.peersLock.RUnlock()
+	}
+	if peer == nil {
+		writeJsonError(w, http.StatusNotFound, "no peer "+parts[0])
+		return
+	}
+	switch {
+	case len(parts) == 1 && r.Method == "GET":
+		writeJson(w, http.StatusOK, self.adminPeer(peer))
+	case len(parts) == 2 && parts[1] == "kill" && r.Method == "POST":
+		fmt.Printf("peer %s: disconnected by admin\n", peer.RemoteAddr())
+		info := self.adminPeer(peer)
+		peer.Close()
+		writeJson(w, http.StatusOK, info)
+	default:
+		writeJsonError(w, http.StatusNotFound, "not found")
+	}
+}
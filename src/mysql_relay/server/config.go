@@ -3,7 +3,9 @@ package server
 import (
 	"encoding/json"
 	"io/ioutil"
+	"mysql_relay/relay"
 	"os"
+	"time"
 )
 
 type Config struct {
@@ -21,9 +23,52 @@ type UpstreamConfig struct {
 	Password      string
 	ServerId      uint32
 	Semisync      bool
+	AutoPosition  bool
+	ChecksumError string // "reconnect" or "stop" on event checksum mismatch
 	RetryInterval uint32
 	MaxRetryTimes uint32
 	ReadTimeout   uint32
+
+	// dump with @@global.binlog_checksum of upstream instead of NONE, checksums are kept in relayed binlogs
+	NegotiateChecksum bool
+	// server_id of relayed events is rewritten to it if not 0
+	RewriteServerId uint32
+	// with Semisync, upstream is acked after so many semisync replicas have acked, 0 not to wait for them
+	SemisyncQuorum uint32
+	// milliseconds to wait for the quorum before acking without it, until replicas catch up
+	SemisyncTimeout uint32
+	// candidate masters switched to after ServerAddr fails, only with AutoPosition
+	ServerAddrs []string
+	// seconds of idle before upstream sends a heartbeat, 0 to disable
+	HeartbeatPeriod uint32
+
+	// relayed binlogs older than RetainHours or beyond RetainMB in total are purged, RetainFiles are kept at least
+	RetainHours uint32
+	RetainMB    uint64
+	RetainFiles uint32
+}
+
+// addresses of candidate masters in the order to try
+func (self *UpstreamConfig) CandidateAddrs() []string {
+	addrs := []string{self.ServerAddr}
+	if !self.AutoPosition {
+		// binlog positions differ between masters, only gtids can be resumed from
+		return addrs
+	}
+	for _, addr := range self.ServerAddrs {
+		if addr != "" && addr != self.ServerAddr {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+func (self *UpstreamConfig) RetentionPolicy() relay.RetentionPolicy {
+	return relay.RetentionPolicy{
+		MaxAge:    time.Duration(self.RetainHours) * time.Hour,
+		MaxSize:   self.RetainMB << 20,
+		KeepFiles: int(self.RetainFiles),
+	}
 }
 
 type UserConfig struct {
@@ -37,6 +82,11 @@ type ServerConfig struct {
 	ServerId uint32
 	Uuid     string
 	Version  string
+	Semisync bool // act as semisync master to replicas
+	// http admin api of json listens if not empty, on a local address unless AdminToken is set
+	AdminAddr string
+	// required by stop, start and kill of the admin api as "Authorization: Bearer <AdminToken>" if not empty
+	AdminToken string
 }
 
 func (self *Config) FromJson(buf []byte) error {
@@ -53,22 +53,71 @@ func (peer *Peer) onCmdQuery(cmdPacket *mysql.BaseCommandPacket) (err error) {
 		return selectVar(peer, "version()", mysql.MYSQL_TYPE_VAR_STRING, mysql.StringValue(peer.Server.Config.Server.Version))
 
 	case "set @master_binlog_checksum='none'":
+		peer.checksum = "NONE"
 		return peer.SendOk(cmdPacket.PacketSeq + 1)
 
 	case "set @master_binlog_checksum=@@global.binlog_checksum":
+		peer.checksum = peer.binlogChecksum()
 		return peer.SendOk(cmdPacket.PacketSeq + 1)
+
+	case "select @@global.binlog_checksum":
+		return selectVar(peer, "@@global.binlog_checksum", mysql.MYSQL_TYPE_VAR_STRING, mysql.StringValue(peer.binlogChecksum()))
 	case "select @@global.gtid_mode":
-		return selectVar(peer, "@@global.gtid_mode", mysql.MYSQL_TYPE_VAR_STRING, mysql.StringValue("OFF"))
+		gtidMode := "OFF"
+		if relay := peer.GetRelay(); relay != nil && relay.GtidMode() {
+			// relayed with gtids, even while upstream is not connected
+			gtidMode = "ON"
+		} else if relay != nil {
+			gtidMode = relay.UpstreamGtidMode()
+		}
+		return selectVar(peer, "@@global.gtid_mode", mysql.MYSQL_TYPE_VAR_STRING, mysql.StringValue(gtidMode))
 
 	case "select @master_binlog_checksum":
-		return selectVar(peer, "@master_binlog_checksum", mysql.MYSQL_TYPE_VAR_STRING, mysql.StringValue("CRC32"))
+		return selectMasterBinlogChecksum(peer)
+
+	// semisync slave plugin probes whether master supports semisync
+	case "show variables like 'rpl_semi_sync_master_enabled'":
+		return showSingleVar(peer, "rpl_semi_sync_master_enabled", peer.Server.semisyncEnabled())
+
+	case "show variables like 'rpl_semi_sync_source_enabled'":
+		return showSingleVar(peer, "rpl_semi_sync_source_enabled", peer.Server.semisyncEnabled())
+
+	case "show binary logs", "show master logs":
+		return showBinaryLogs(peer)
+
+	case "show master status", "show binary log status":
+		return showMasterStatus(peer)
+
+	case "show slave hosts":
+		return showSlaveHosts(peer, false)
+
+	case "show replicas":
+		return showSlaveHosts(peer, true)
+
+	case "set @rpl_semi_sync_slave=1", "set @rpl_semi_sync_replica=1":
+		peer.stateLock.Lock()
+		peer.semisync = peer.Server.Config.Server.Semisync
+		peer.stateLock.Unlock()
+		return peer.SendOk(cmdPacket.PacketSeq + 1)
 	}
 	if strings.HasPrefix(query, "set @master_heartbeat_period=") {
+		// in nanoseconds, 0 to disable
+		period, err := strconv.ParseFloat(strings.TrimSpace(query[strings.Index(query, "=")+1:]), 64)
+		if err == nil && period >= 0 {
+			peer.heartbeat = time.Duration(period)
+		}
 		return peer.SendOk(cmdPacket.PacketSeq + 1)
-	} else if strings.HasPrefix(query, "set @slave_uuid=") {
+	} else if strings.HasPrefix(query, "set @slave_uuid=") || strings.HasPrefix(query, "set @replica_uuid=") {
+		peer.stateLock.Lock()
+		peer.slaveUuid = strings.Trim(query[strings.Index(query, "=")+1:], "'\"")
+		peer.stateLock.Unlock()
 		return peer.SendOk(cmdPacket.PacketSeq + 1)
 	} else if strings.HasPrefix(query, "set names ") {
 		return peer.SendOk(cmdPacket.PacketSeq + 1)
+	} else if strings.HasPrefix(query, "show slave status") || strings.HasPrefix(query, "show replica status") {
+		return showSlaveStatus(peer, cmdPacket)
+	} else if strings.HasPrefix(query, "purge ") {
+		return peer.onPurgeBinaryLogs(cmdPacket)
 	}
 	errPacket := mysql.BuildErrPacket(mysql.ER_NOT_SUPPORTED_YET, "this")
 	errPacket.PacketSeq = cmdPacket.PacketSeq + 1
@@ -77,6 +126,21 @@ func (peer *Peer) onCmdQuery(cmdPacket *mysql.BaseCommandPacket) (err error) {
 	return
 }
 
+func (self *Server) semisyncEnabled() string {
+	if self.Config.Server.Semisync {
+		return "ON"
+	}
+	return "OFF"
+}
+
+// checksum algorithm of binlogs relayed
+func (peer *Peer) binlogChecksum() string {
+	if relay := peer.GetRelay(); relay != nil {
+		return relay.BinlogChecksum()
+	}
+	return "NONE"
+}
+
 func selectVar(peer *Peer, name string, columnType byte, value mysql.Value) (err error) {
 	var length uint32
 	if value.IsNull {
@@ -106,8 +170,7 @@ func selectVar(peer *Peer, name string, columnType byte, value mysql.Value) (err
 	cursor.Rows <- mysql.ResultRow{Values: []mysql.Value{
 		value,
 	}}
-	close(cursor.Rows)
-	return
+	return cursor.EndWrite()
 }
 
 func selectMasterBinlogChecksum(peer *Peer) (err error) {
@@ -131,11 +194,14 @@ func selectMasterBinlogChecksum(peer *Peer) (err error) {
 	if err != nil {
 		return
 	}
+	value := mysql.NullValue()
+	if peer.checksum != "" {
+		value = mysql.StringValue(peer.checksum)
+	}
 	cursor.Rows <- mysql.ResultRow{Values: []mysql.Value{
-		mysql.StringValue("CRC32"),
+		value,
 	}}
-	close(cursor.Rows)
-	return
+	return cursor.EndWrite()
 }
 
 func showSingleVar(peer *Peer, name string, value string) (err error) {
@@ -181,8 +247,7 @@ func showSingleVar(peer *Peer, name string, value string) (err error) {
 		{Value: name, IsNull: false},
 		{Value: value, IsNull: false},
 	}}
-	close(cursor.Rows)
-	return
+	return cursor.EndWrite()
 }
 
 func (peer *Peer) onCmdPing(cmdPacket *mysql.BaseCommandPacket) (err error) {
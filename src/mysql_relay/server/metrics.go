@@ -0,0 +1,69 @@
+package server
+
+import (
+	"io"
+	"mysql_relay/util"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+)
+
+var upstreamReconnects = util.Metrics.NewCounterVec("mysql_relay_upstream_reconnects_total",
+	"Attempts to connect an upstream again after the first.", "upstream")
+
+// counts bytes written to the peer
+type countingWriter struct {
+	w     io.Writer
+	count *uint64
+}
+
+func (self countingWriter) Write(p []byte) (n int, err error) {
+	n, err = self.w.Write(p)
+	atomic.AddUint64(self.count, uint64(n))
+	return
+}
+
+// copy by sendfile when w is a tcp connection and r a file
+func (self countingWriter) ReadFrom(r io.Reader) (n int64, err error) {
+	n, err = io.Copy(self.w, r)
+	atomic.AddUint64(self.count, uint64(n))
+	return
+}
+
+// metrics of peers are read from the peers connected when collected
+func (self *Server) registerMetrics() {
+	labels := []string{"conn_id", "user", "server_id"}
+	dumping := func(emit func(peer *Peer, values ...string)) {
+		for _, peer := range self.PeerList() {
+			if name, _ := peer.SendingPosition(); name != "" {
+				emit(peer, strconv.FormatUint(uint64(peer.ConnId), 10), peer.User,
+					strconv.FormatUint(uint64(peer.ClientServerId), 10))
+			}
+		}
+	}
+	util.Metrics.NewGaugeFunc("mysql_relay_peers_connected", "Peers connected, including those not dumping.",
+		nil, func(emit func(v float64, values ...string)) {
+			emit(float64(len(self.PeerList())))
+		})
+	util.Metrics.NewCounterFunc("mysql_relay_peer_bytes_sent_total", "Bytes sent to peers dumping binlogs.",
+		labels, func(emit func(v float64, values ...string)) {
+			dumping(func(peer *Peer, values ...string) {
+				emit(float64(atomic.LoadUint64(&peer.bytesSent)), values...)
+			})
+		})
+	util.Metrics.NewGaugeFunc("mysql_relay_peer_lag_bytes", "Bytes of relay binlogs not yet sent to peers dumping.",
+		labels, func(emit func(v float64, values ...string)) {
+			dumping(func(peer *Peer, values ...string) {
+				if relay := peer.GetRelay(); relay != nil {
+					name, pos := peer.SendingPosition()
+					emit(float64(relay.BytesBehind(name, pos)), values...)
+				}
+			})
+		})
+}
+
+// GET /metrics
+func (self *Server) onMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	util.Metrics.WriteTo(w)
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"fmt"
+	"mysql_relay/mysql"
+	"mysql_relay/relay"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const PURGE_INTERVAL = time.Minute
+
+var purgeRegEx = regexp.MustCompile(`(?i)^\s*purge\s+(?:binary|master)\s+logs\s+(to|before)\s+'([^']*)'\s*;?\s*$`)
+
+func (peer *Peer) setSendingPosition(name string, pos uint32) {
+	peer.stateLock.Lock()
+	peer.sendingBinlog, peer.sendingPos = name, pos
+	peer.stateLock.Unlock()
+}
+
+// the binlog being sent and the position sent to, "" if not dumping
+func (peer *Peer) SendingPosition() (name string, pos uint32) {
+	peer.stateLock.Lock()
+	defer peer.stateLock.Unlock()
+	return peer.sendingBinlog, peer.sendingPos
+}
+
+// the first binlog being sent to peers of the upstream, binlogs since it are not purged
+func (self *Server) firstSendingIndex(upstream string, relay *relay.BinlogRelay) int {
+	first := int(^uint(0) >> 1)
+	for _, peer := range self.PeerList() {
+		user, ok := self.Config.Users[peer.User]
+		if !ok || user.Upstream != upstream {
+			continue
+		}
+		if name, _ := peer.SendingPosition(); name != "" {
+			if index := relay.FindIndex(name); index >= 0 && index < first {
+				first = index
+			}
+		}
+	}
+	return first
+}
+
+// purge binlogs of every upstream as its retention policy
+func (self *Server) runPurger() {
+	for range time.Tick(PURGE_INTERVAL) {
+		for _, name := range self.UpstreamNames() {
+			relay := self.GetUpstream(name)
+			if relay == nil {
+				continue
+			}
+			n, err := relay.PurgeByRetention(self.firstSendingIndex(name, relay))
+			if err != nil {
+				fmt.Printf("upstream %s: purge: %s\n", name, err.Error())
+			} else if n > 0 {
+				fmt.Printf("upstream %s: purged %d binlogs\n", name, n)
+			}
+		}
+	}
+}
+
+// PURGE BINARY LOGS TO 'name' or BEFORE 'datetime', binlogs being sent are kept
+func (peer *Peer) onPurgeBinaryLogs(cmdPacket *mysql.BaseCommandPacket) (err error) {
+	query := string(peer.Buffer[1:cmdPacket.PacketLength])
+	match := purgeRegEx.FindStringSubmatch(query)
+	relay := peer.GetRelay()
+	var errPacket mysql.ErrPacket
+	var index int
+	if match == nil {
+		errPacket = mysql.BuildErrPacket(mysql.ER_NOT_SUPPORTED_YET, "this")
+	} else if relay == nil {
+		errPacket = mysql.BuildErrPacket(mysql.ER_LOG_PURGE_NO_FILE, match[2])
+	} else if strings.EqualFold(match[1], "to") {
+		if index = relay.FindIndex(match[2]); index < 0 {
+			errPacket = mysql.BuildErrPacket(mysql.ER_UNKNOWN_TARGET_BINLOG)
+		}
+	} else if before, perr := parseDatetime(match[2]); perr != nil {
+		errPacket = mysql.BuildErrPacket(mysql.ER_WRONG_ARGUMENTS, "PURGE LOGS BEFORE")
+	} else if index, err = relay.FindIndexModifiedSince(before); err != nil {
+		errPacket = mysql.BuildErrPacket(mysql.ER_LOG_PURGE_UNKNOWN_ERR)
+	}
+	if errPacket.ErrorCode == 0 {
+		upstream := peer.Server.Config.Users[peer.User].Upstream
+		if protected := peer.Server.firstSendingIndex(upstream, relay); index > protected {
+			fmt.Printf("peer %s: %s being sent is not purged\n", peer.RemoteAddr(), relay.NameByIndex(protected))
+			index = protected
+		}
+		var n int
+		if n, err = relay.PurgeBefore(index); err != nil {
+			fmt.Printf("peer %s: purge: %s\n", peer.RemoteAddr(), err.Error())
+			errPacket = mysql.BuildErrPacket(mysql.ER_LOG_PURGE_UNKNOWN_ERR)
+		} else {
+			fmt.Printf("peer %s: purged %d binlogs\n", peer.RemoteAddr(), n)
+			return peer.SendOk(cmdPacket.PacketSeq + 1)
+		}
+	}
+	errPacket.PacketSeq = cmdPacket.PacketSeq + 1
+	return mysql.WritePacketTo(&errPacket, peer.Conn, peer.Buffer[:])
+}
+
+func parseDatetime(s string) (t time.Time, err error) {
+	t, err = time.ParseInLocation("2006-01-02 15:04:05", s, time.Local)
+	if err != nil {
+		t, err = time.ParseInLocation("2006-01-02", s, time.Local)
+	}
+	return
+}
@@ -0,0 +1,102 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"mysql_relay/mysql"
+)
+
+const SEMISYNC_ACK_BUFFER_SIZE = 1024
+
+// milliseconds to wait for the quorum of replicas, as rpl_semi_sync_master_timeout
+const DEFAULT_SEMISYNC_TIMEOUT = 10000
+
+// whether the event ends a transaction, so the peer is asked to ack it.
+// the body of a small QUERY_EVENT is read to peer.Buffer, buffered is bytes of event in buffer
+func (peer *Peer) endsTransaction(event *mysql.BinlogEventPacket, file io.Reader, buffered int) (ends bool, n int, err error) {
+	n = buffered
+	switch event.EventType {
+	case mysql.XID_EVENT:
+		peer.inTransaction = false
+		ends = true
+	case mysql.QUERY_EVENT:
+		query := ""
+		if int(event.PacketLength) <= len(peer.Buffer) {
+			if n < int(event.PacketLength) {
+				if _, err = io.ReadFull(file, peer.Buffer[n:event.PacketLength]); err != nil {
+					return
+				}
+				n = int(event.PacketLength)
+			}
+			var queryEvent mysql.QueryEvent
+			if err = queryEvent.Parse(event, peer.Buffer[:n]); err != nil {
+				return
+			}
+			query = queryEvent.Query
+		}
+		switch query {
+		case "BEGIN":
+			peer.inTransaction = true
+		case "COMMIT", "ROLLBACK":
+			peer.inTransaction = false
+			ends = true
+		default:
+			ends = !peer.inTransaction // ddl
+		}
+	}
+	return
+}
+
+// read acks from a semisync peer while binlog is sent, acks count to the quorum of the relay of the upstream
+func (peer *Peer) readSemisyncAcks() {
+	var buffer [SEMISYNC_ACK_BUFFER_SIZE]byte
+	defer func() {
+		if relay := peer.GetRelay(); relay != nil {
+			relay.RemoveDownstream(peer.ClientServerId)
+		}
+	}()
+	for {
+		var headerBuffer [4]byte
+		_, err := io.ReadFull(peer.Conn, headerBuffer[:])
+		if err != nil {
+			if err != io.EOF {
+				fmt.Printf("peer %s: read semisync ack: %s\n", peer.RemoteAddr(), err.Error())
+			}
+			return
+		}
+		var ack mysql.SemisyncAckPacket
+		ack.FromUint32(mysql.ENDIAN.Uint32(headerBuffer[:]))
+		if int(ack.PacketLength) > len(buffer) {
+			fmt.Printf("peer %s: semisync ack too large: %d\n", peer.RemoteAddr(), ack.PacketLength)
+			peer.Close()
+			return
+		}
+		_, err = io.ReadFull(peer.Conn, buffer[:ack.PacketLength])
+		if err == nil {
+			_, err = ack.FromBuffer(buffer[:])
+		}
+		if err != nil {
+			fmt.Printf("peer %s: read semisync ack: %s\n", peer.RemoteAddr(), err.Error())
+			peer.Close()
+			return
+		}
+		peer.onSemisyncAck(ack.Name, ack.Position)
+		if relay := peer.GetRelay(); relay != nil {
+			relay.AckDownstream(peer.ClientServerId, ack.Name, ack.Position)
+		}
+	}
+}
+
+func (peer *Peer) onSemisyncAck(name string, pos uint64) {
+	peer.ackLock.Lock()
+	peer.ackName, peer.ackPos = name, pos
+	peer.ackLock.Unlock()
+	//fmt.Printf("peer %s: semisync ack %s:%d\n", peer.RemoteAddr(), name, pos)
+}
+
+// the last position acked by the peer
+func (peer *Peer) SemisyncAckPosition() (name string, pos uint64) {
+	peer.ackLock.Lock()
+	defer peer.ackLock.Unlock()
+	return peer.ackName, peer.ackPos
+}
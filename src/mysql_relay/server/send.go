@@ -0,0 +1,135 @@
+package server
+
+import (
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"mysql_relay/mysql"
+)
+
+// whether events sent to the peer should have checksum
+func (peer *Peer) wantChecksum() bool {
+	return peer.checksum == "CRC32"
+}
+
+// send an event read from binlog, with checksum added or removed as the peer negotiated.
+// the semisync header is added as event.Semisync.
+// peer.Buffer[:buffered] holds the ok byte and the beginning of the event, the rest is read from file.
+// EventSize is that of the event sent, but LogPos is not adjusted: the peer reports it as its position
+// in the binlog, to dump from again and in semisync acks, which must be the end of the event stored.
+// positions added up from sizes of events sent would not be at events of the binlog
+func (peer *Peer) sendEvent(event *mysql.BinlogEventPacket, file io.Reader, buffered int) (err error) {
+	if event.EventType == mysql.FORMAT_DESCRIPTION_EVENT {
+		return peer.sendFormatDescriptionEvent(event, file, buffered)
+	}
+	strip := peer.fileChecksum && !peer.sendChecksum
+	add := !peer.fileChecksum && peer.sendChecksum
+	eventSize := event.EventSize
+	if strip {
+		eventSize -= 4
+	} else if add {
+		eventSize += 4
+	}
+	mysql.ENDIAN.PutUint32(peer.Buffer[10:], eventSize)
+	var packet io.Writer
+	if packet, err = peer.writeEventPacketHeader(event, eventSize); err != nil {
+		return
+	}
+
+	// bytes of event from binlog to send
+	remained := int(event.EventSize) + 1
+	if strip {
+		remained -= 4
+	}
+	first := buffered
+	if first > remained {
+		first = remained
+	}
+	out := packet
+	checksum := crc32.NewIEEE()
+	if add {
+		out = io.MultiWriter(packet, checksum)
+	}
+	if _, err = out.Write(peer.Buffer[1:first]); err != nil {
+		return
+	}
+	if _, err = io.CopyN(out, file, int64(remained-first)); err != nil {
+		return
+	}
+
+	if strip {
+		// skip the checksum in binlog
+		if rest := int(event.EventSize) + 1 - buffered - (remained - first); rest > 0 {
+			_, err = io.CopyN(ioutil.Discard, file, int64(rest))
+		}
+	} else if add {
+		var sum [4]byte
+		mysql.ENDIAN.PutUint32(sum[:], checksum.Sum32())
+		_, err = packet.Write(sum[:])
+	}
+	return
+}
+
+// the checksum algorithm of FORMAT_DESCRIPTION_EVENT is rewritten to what the peer negotiated.
+// events of the binlog following are converted accordingly
+func (peer *Peer) sendFormatDescriptionEvent(event *mysql.BinlogEventPacket, file io.Reader, buffered int) (err error) {
+	size := int(event.EventSize) + 1
+	if size > len(peer.Buffer) {
+		return fmt.Errorf("FORMAT_DESCRIPTION_EVENT too large: %d", event.EventSize)
+	}
+	if buffered < size {
+		if _, err = io.ReadFull(file, peer.Buffer[buffered:size]); err != nil {
+			return
+		}
+	}
+	event.PacketLength = event.EventSize + 1
+	event.BodyLength = int(event.EventSize) - mysql.BinlogEventHeaderSize
+	var fde mysql.FormatDescriptionEvent
+	if err = fde.Parse(event, peer.Buffer[:size]); err != nil {
+		return
+	}
+	tail := int(event.EventSize) - int(fde.EventHeaderLength) - int(fde.EventTypeHeaderLength[mysql.FORMAT_DESCRIPTION_EVENT-1])
+	if tail == 1+4 {
+		// FORMAT_DESCRIPTION_EVENT with the algorithm is always checksummed
+		peer.fileChecksum = fde.ChecksumAlgorism == mysql.BINLOG_CHECKSUM_ALG_CRC32
+		peer.sendChecksum = peer.wantChecksum()
+		if peer.sendChecksum {
+			peer.Buffer[size-5] = mysql.BINLOG_CHECKSUM_ALG_CRC32
+		} else {
+			peer.Buffer[size-5] = mysql.BINLOG_CHECKSUM_ALG_OFF
+		}
+		mysql.ENDIAN.PutUint32(peer.Buffer[size-4:], crc32.ChecksumIEEE(peer.Buffer[1:size-4]))
+	} else {
+		// binlog before 5.6 has no checksum, nor could it be added
+		peer.fileChecksum = false
+		peer.sendChecksum = false
+	}
+
+	var packet io.Writer
+	if packet, err = peer.writeEventPacketHeader(event, event.EventSize); err != nil {
+		return
+	}
+	_, err = packet.Write(peer.Buffer[1:size])
+	return
+}
+
+// write the packet header, the ok byte and the semisync header if any, for an event of eventSize.
+// the event is written to packet, split into packets of MAX_PACKET_LENGTH if as large,
+// with peer.seq moved past all of them
+func (peer *Peer) writeEventPacketHeader(event *mysql.BinlogEventPacket, eventSize uint32) (packet io.Writer, err error) {
+	var header [3]byte
+	n := 1
+	if event.Semisync != mysql.SEMISYNC_NO {
+		header[1] = mysql.SEMISYNC_INDICATOR
+		if event.Semisync == mysql.SEMISYNC_ACK {
+			header[2] = mysql.SEMISYNC_FLAG_ACK
+		}
+		n = 3
+	}
+	length := int(eventSize) + n
+	packet = mysql.NewPayloadWriter(peer.out, length, event.PacketSeq)
+	peer.seq = event.PacketSeq + byte(mysql.PacketCount(length))
+	_, err = packet.Write(header[:n])
+	return
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"hash/crc32"
+	"io/ioutil"
+	"mysql_relay/mysql"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// a binlog of FORMAT_DESCRIPTION_EVENT and QUERY_EVENTs with bodies of sizes, events are returned as well
+func buildTestBinlogChecksum(checksum bool, sizes []int) (binlog []byte, events [][]byte) {
+	alg := byte(mysql.BINLOG_CHECKSUM_ALG_OFF)
+	if checksum {
+		alg = mysql.BINLOG_CHECKSUM_ALG_CRC32
+	}
+	binlog = []byte{'\xfe', 'b', 'i', 'n'}
+	events = [][]byte{buildTestFormatDescriptionAlg(alg)}
+	binlog = append(binlog, events[0]...)
+	for i, size := range sizes {
+		body := make([]byte, size)
+		for j := range body {
+			body[j] = byte(i + j)
+		}
+		event := buildTestEventChecksum(mysql.QUERY_EVENT, uint32(len(binlog)), body, checksum)
+		events = append(events, event)
+		binlog = append(binlog, event...)
+	}
+	return
+}
+
+// the event in the next packet, without the ok byte
+func readTestEventBytes(conn net.Conn, timeout time.Duration) (event []byte, err error) {
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	header, err := mysql.ReadPacketHeader(conn)
+	if err != nil {
+		return
+	}
+	buffer := make([]byte, header.PacketLength)
+	if err = mysql.ReadPacket(header, conn, buffer); err != nil {
+		return
+	}
+	return buffer[1:], nil
+}
+
+func TestSendEventConvertingChecksum(t *testing.T) {
+	for _, c := range []struct {
+		fileChecksum bool
+		peerChecksum string
+	}{
+		{true, ""},
+		{false, "CRC32"},
+	} {
+		dir, err := ioutil.TempDir("", "peer")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		binlog, events := buildTestBinlogChecksum(c.fileChecksum, []int{8, 100, 3 * PEER_BUFFER_SIZE})
+		peer, downstream := newTestPeer(t, dir, binlog)
+		peer.checksum = c.peerChecksum
+		ended := startTestDump(peer, "log-bin.000001", mysql.LOG_POS_START)
+		if event, err := readTestEvent(downstream, time.Second); err != nil || event.EventType != mysql.ROTATE_EVENT {
+			t.Fatalf("got %s, %v", event.String(), err)
+		}
+
+		fde, err := readTestEventBytes(downstream, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		alg := byte(mysql.BINLOG_CHECKSUM_ALG_OFF)
+		if c.peerChecksum == "CRC32" {
+			alg = mysql.BINLOG_CHECKSUM_ALG_CRC32
+		}
+		n := len(fde)
+		if n != len(events[0]) || mysql.ENDIAN.Uint32(fde[9:]) != uint32(n) || fde[n-5] != alg {
+			t.Errorf("%s peer: FORMAT_DESCRIPTION_EVENT of size %d, algorithm %d", c.peerChecksum, n, fde[n-5])
+		}
+		if mysql.ENDIAN.Uint32(fde[n-4:]) != crc32.ChecksumIEEE(fde[:n-4]) {
+			t.Errorf("%s peer: bad checksum of FORMAT_DESCRIPTION_EVENT", c.peerChecksum)
+		}
+
+		for _, expected := range events[1:] {
+			event, err := readTestEventBytes(downstream, time.Second)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body := expected[mysql.BinlogEventHeaderSize:]
+			if c.fileChecksum {
+				body = body[:len(body)-4]
+			}
+			size := mysql.BinlogEventHeaderSize + len(body)
+			if c.peerChecksum == "CRC32" {
+				size += 4
+			}
+			if len(event) != size || mysql.ENDIAN.Uint32(event[9:]) != uint32(size) {
+				t.Fatalf("%s peer: event of %d bytes, EventSize %d, expected %d", c.peerChecksum, len(event), mysql.ENDIAN.Uint32(event[9:]), size)
+			}
+			// positions are still those of the binlog
+			if mysql.ENDIAN.Uint32(event[13:]) != mysql.ENDIAN.Uint32(expected[13:]) {
+				t.Errorf("%s peer: LogPos %d, expected %d", c.peerChecksum, mysql.ENDIAN.Uint32(event[13:]), mysql.ENDIAN.Uint32(expected[13:]))
+			}
+			if string(event[mysql.BinlogEventHeaderSize:mysql.BinlogEventHeaderSize+len(body)]) != string(body) {
+				t.Errorf("%s peer: body changed", c.peerChecksum)
+			}
+			if c.peerChecksum == "CRC32" && mysql.ENDIAN.Uint32(event[size-4:]) != crc32.ChecksumIEEE(event[:size-4]) {
+				t.Errorf("%s peer: bad checksum", c.peerChecksum)
+			}
+		}
+		downstream.Close()
+		<-ended
+		peer.Close()
+	}
+}
@@ -0,0 +1,70 @@
+package server
+
+import (
+	"bufio"
+	"io"
+	"mysql_relay/mysql"
+	"os"
+)
+
+const PEER_READ_BUFFER_SIZE = 65536
+
+// bodies of events as large are copied from binlog to socket by sendfile, smaller ones are batched
+const SENDFILE_MIN_EVENT_SIZE = 16384
+
+// whether events are sent as they are in binlog, with neither checksum converted, semisync header added
+// nor transactions skipped
+func (peer *Peer) sendsAsIs() bool {
+	return !peer.semisync && peer.skipGtids == nil && peer.fileChecksum == peer.sendChecksum
+}
+
+// send events of binlog in [from, to) as they are, until FORMAT_DESCRIPTION_EVENT or an event too large for
+// one packet, which are left at pos for sendEvent. events are read from file many at a time and only packet
+// headers and ok bytes are built in user space. bodies of large events are sent by sendfile
+func (peer *Peer) sendEventsAsIs(file *os.File, from uint32, to uint32) (pos uint32, err error) {
+	pos = from
+	reader := bufio.NewReaderSize(io.NewSectionReader(file, int64(pos), int64(to-pos)), PEER_READ_BUFFER_SIZE)
+	direct := countingWriter{peer.Conn, &peer.bytesSent}
+	peer.Buffer[0] = '\x00'
+	for pos < to {
+		if _, err = io.ReadFull(reader, peer.Buffer[1:mysql.BinlogEventHeaderSize+1]); err != nil {
+			return
+		}
+		var event mysql.BinlogEventPacket
+		event.FromBuffer(peer.Buffer[:])
+		if err = peer.checkEventPos(&event, file, pos); err != nil {
+			return
+		}
+		if event.EventType == mysql.FORMAT_DESCRIPTION_EVENT || event.EventSize+1 >= mysql.MAX_PACKET_LENGTH {
+			return
+		}
+		event.PacketSeq = peer.seq
+		var packet io.Writer
+		if packet, err = peer.writeEventPacketHeader(&event, event.EventSize); err != nil {
+			return
+		}
+		if _, err = packet.Write(peer.Buffer[1 : mysql.BinlogEventHeaderSize+1]); err != nil {
+			return
+		}
+		body := int64(event.EventSize) - mysql.BinlogEventHeaderSize
+		next := pos + event.EventSize
+		if event.EventSize < SENDFILE_MIN_EVENT_SIZE {
+			if _, err = io.CopyN(peer.out, reader, body); err != nil {
+				return
+			}
+		} else {
+			if err = peer.out.Flush(); err != nil {
+				return
+			}
+			if _, err = file.Seek(int64(pos)+mysql.BinlogEventHeaderSize, 0); err != nil {
+				return
+			}
+			if _, err = io.CopyN(direct, file, body); err != nil {
+				return
+			}
+			reader.Reset(io.NewSectionReader(file, int64(next), int64(to-next)))
+		}
+		pos = next
+	}
+	return
+}
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"mysql_relay/mysql"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// the event in the next packets, joined if split at MAX_PACKET_LENGTH, without the ok byte
+func readTestLargeEventBytes(conn net.Conn, timeout time.Duration) (event []byte, err error) {
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	for {
+		var header mysql.PacketHeader
+		if header, err = mysql.ReadPacketHeader(conn); err != nil {
+			return
+		}
+		payload := make([]byte, header.PacketLength)
+		if _, err = io.ReadFull(conn, payload); err != nil {
+			return
+		}
+		event = append(event, payload...)
+		if header.PacketLength < mysql.MAX_PACKET_LENGTH {
+			return event[1:], nil
+		}
+	}
+}
+
+func TestSendEventsAsIs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "peer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// small events are batched, large ones are sent by sendfile with the reader reset after
+	binlog, events := buildTestBinlogChecksum(true, []int{8, 2 * SENDFILE_MIN_EVENT_SIZE, 100,
+		SENDFILE_MIN_EVENT_SIZE - mysql.BinlogEventHeaderSize - 5, SENDFILE_MIN_EVENT_SIZE - mysql.BinlogEventHeaderSize - 4, 30})
+	// an event of MAX_PACKET_LENGTH is left to sendEvent, then events are sent as is again
+	for _, size := range []int{50, mysql.MAX_PACKET_LENGTH - 1 - mysql.BinlogEventHeaderSize - 4, 3 * SENDFILE_MIN_EVENT_SIZE, 10} {
+		event := buildTestEventChecksum(mysql.QUERY_EVENT, uint32(len(binlog)), make([]byte, size), true)
+		events = append(events, event)
+		binlog = append(binlog, event...)
+	}
+	// so is a FORMAT_DESCRIPTION_EVENT, after which events without checksum are sent with it added
+	fde := buildTestFormatDescriptionAlg(mysql.BINLOG_CHECKSUM_ALG_OFF)
+	mysql.ENDIAN.PutUint32(fde[13:], uint32(len(binlog)+len(fde)))
+	mysql.ENDIAN.PutUint32(fde[len(fde)-4:], crc32.ChecksumIEEE(fde[:len(fde)-4]))
+	binlog = append(binlog, fde...)
+	fde = append([]byte(nil), fde...)
+	fde[len(fde)-5] = mysql.BINLOG_CHECKSUM_ALG_CRC32
+	mysql.ENDIAN.PutUint32(fde[len(fde)-4:], crc32.ChecksumIEEE(fde[:len(fde)-4]))
+	events = append(events, fde)
+	for _, size := range []int{20, 2 * SENDFILE_MIN_EVENT_SIZE} {
+		event := buildTestEventChecksum(mysql.QUERY_EVENT, uint32(len(binlog)), make([]byte, size), false)
+		binlog = append(binlog, event...)
+		event = append([]byte(nil), event...)
+		mysql.ENDIAN.PutUint32(event[9:], uint32(len(event)+4))
+		var sum [4]byte
+		mysql.ENDIAN.PutUint32(sum[:], crc32.ChecksumIEEE(event))
+		events = append(events, append(event, sum[:]...))
+	}
+
+	peer, downstream := newTestPeer(t, dir, binlog)
+	ended := startTestDump(peer, "log-bin.000001", mysql.LOG_POS_START)
+	if event, err := readTestEvent(downstream, time.Second); err != nil || event.EventType != mysql.ROTATE_EVENT {
+		t.Fatalf("got %s, %v", event.String(), err)
+	}
+	for i, expected := range events {
+		event, err := readTestLargeEventBytes(downstream, 5*time.Second)
+		if err != nil {
+			t.Fatalf("event %d: %s", i, err.Error())
+		}
+		if string(event) != string(expected) {
+			t.Fatalf("event %d: %d bytes received differ from %d bytes expected", i, len(event), len(expected))
+		}
+	}
+	downstream.Close()
+	<-ended
+	peer.Close()
+}
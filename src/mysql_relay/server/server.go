@@ -1,8 +1,9 @@
 package server
 
 import (
+	"bufio"
+	"errors"
 	"fmt"
-	"hash/crc32"
 	"io"
 	"io/ioutil"
 	"mysql_relay/mysql"
@@ -12,6 +13,7 @@ import (
 	"os"
 	"regexp"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 )
@@ -19,14 +21,18 @@ import (
 type Server struct {
 	Addr       string
 	Peers      map[uint32]*Peer
+	peersLock  sync.RWMutex
 	NextConnId uint32
 	Closed     chan uint32
 	//
 	Config
-	Upstreams map[string]*relay.BinlogRelay
+	Upstreams     map[string]*relay.BinlogRelay
+	upstreamsLock sync.RWMutex
+	controls      map[string]*upstreamControl
 }
 
 const PEER_BUFFER_SIZE = 1024
+const PEER_WRITE_BUFFER_SIZE = 65536
 
 type Peer struct {
 	ConnId         uint32
@@ -36,10 +42,51 @@ type Peer struct {
 	ClientServerId uint32
 	Buffer         [PEER_BUFFER_SIZE]byte
 	seq            byte
+	skipGtids      mysql.GtidSet // gtids the peer already has, when dumping by gtid
+	skipping       bool
+	checksum       string // @master_binlog_checksum of the peer
+	fileChecksum   bool   // whether events of the binlog being sent have checksum
+	sendChecksum   bool   // whether events sent have checksum
+	out            *bufio.Writer
+	semisync       bool // whether the peer is a semisync slave, set under stateLock as read by admin
+	inTransaction  bool
+	ackLock        sync.Mutex
+	ackName        string
+	ackPos         uint64
+	stateLock      sync.Mutex // guards fields below, read by other peers
+	sendingBinlog  string     // binlog being sent, kept from purge
+	sendingPos     uint32
+	registration   *mysql.ComRegisterSlave
+	slaveUuid      string
+	bytesSent      uint64 // by dumps, accessed atomically
+	dumpStartName  string // as requested, for errors reading binlog
+	dumpStartPos   uint32
+	heartbeat      time.Duration // @master_heartbeat_period, 0 if no heartbeat
+	done           chan struct{} // closed by Close
 }
 
+var PEER_CLOSED = errors.New("peer closed")
+
 func (self *Peer) Close() {
 	self.Conn.Close()
+	self.Done()
+	self.stateLock.Lock()
+	select {
+	case <-self.done:
+	default:
+		close(self.done)
+	}
+	self.stateLock.Unlock()
+}
+
+// closed once the peer is closed, by admin or after the connection ended
+func (self *Peer) Done() <-chan struct{} {
+	self.stateLock.Lock()
+	defer self.stateLock.Unlock()
+	if self.done == nil {
+		self.done = make(chan struct{})
+	}
+	return self.done
 }
 
 func (self *Peer) RemoteAddr() *net.TCPAddr {
@@ -98,11 +145,18 @@ func (self *Peer) GetRelay() *relay.BinlogRelay {
 	if !ok {
 		return nil
 	}
-	relay, ok := self.Server.Upstreams[user.Upstream]
-	if !ok {
-		return nil
+	return self.Server.GetUpstream(user.Upstream)
+}
+
+// peers connected
+func (self *Server) PeerList() []*Peer {
+	self.peersLock.RLock()
+	defer self.peersLock.RUnlock()
+	peers := make([]*Peer, 0, len(self.Peers))
+	for _, peer := range self.Peers {
+		peers = append(peers, peer)
 	}
-	return relay
+	return peers
 }
 
 func (self *Server) CheckHost(host string) bool {
@@ -124,51 +178,18 @@ func hostContains(sNet string, sHost string) bool {
 
 func (self *Server) Init() {
 	self.Upstreams = make(map[string]*relay.BinlogRelay)
+	self.controls = make(map[string]*upstreamControl)
 	self.Closed = make(chan uint32)
 	self.Peers = make(map[uint32]*Peer)
 }
 
 func (self *Server) StartUpstreams() (err error) {
 	for name, upstreamConfig := range self.Config.Upstreams {
-		fmt.Println("starting " + name)
-		c := mysql.Client{
-			ServerAddr: upstreamConfig.ServerAddr,
-			Username:   upstreamConfig.Username,
-			Password:   upstreamConfig.Password,
-			ServerId:   upstreamConfig.ServerId,
+		if len(upstreamConfig.ServerAddrs) > 0 && !upstreamConfig.AutoPosition {
+			fmt.Printf("upstream %s: ServerAddrs ignored without AutoPosition\n", name)
 		}
-		go func() {
-			nTry := uint32(0)
-			for {
-				if nTry < upstreamConfig.MaxRetryTimes {
-					fmt.Printf("try connecting %d\n", nTry)
-					err := c.Connect()
-					if err != nil {
-						fmt.Println("connect failed")
-						time.Sleep(time.Duration(upstreamConfig.RetryInterval) * time.Second)
-						nTry++
-						continue
-					} else {
-						nTry = uint32(0)
-					}
-				} else {
-					break
-				}
-				fmt.Printf("connected %d\n", nTry)
-				relay := new(relay.BinlogRelay)
-				if upstreamConfig.ReadTimeout > 0 {
-					c.Conn = util.NewTimeoutConn(c.Conn, upstreamConfig.ReadTimeout)
-				}
-				err = relay.Init(name, c, upstreamConfig.LocalDir, upstreamConfig.StartFile)
-				if err != nil {
-					return
-				}
-				relay.SetSemisync(upstreamConfig.Semisync)
-				self.Upstreams[name] = relay
-				_ = relay.Run()
-			}
-			fmt.Println("upstram ended")
-		}()
+		self.controls[name] = new(upstreamControl)
+		self.StartUpstream(name)
 	}
 	return
 }
@@ -179,6 +200,11 @@ func (self *Server) Run() (err error) {
 	if err != nil {
 		return
 	}
+	go self.runPurger()
+	self.registerMetrics()
+	if self.Config.Server.AdminAddr != "" {
+		go self.serveAdmin()
+	}
 	err = self.BeginListen()
 	return
 }
@@ -192,7 +218,9 @@ func (self *Server) BeginListen() (err error) {
 	defer listen.Close()
 	go func() {
 		for closed := range self.Closed {
+			self.peersLock.Lock()
 			delete(self.Peers, closed)
+			self.peersLock.Unlock()
 		}
 	}()
 	for {
@@ -211,13 +239,16 @@ func (self *Server) BeginListen() (err error) {
 			delayer.Reset()
 		}
 		connId := self.GetNextConnId()
-		self.Peers[connId] = &Peer{ConnId: connId, Conn: conn, Server: self}
+		peer := &Peer{ConnId: connId, Conn: conn, Server: self}
+		self.peersLock.Lock()
+		self.Peers[connId] = peer
+		self.peersLock.Unlock()
 		go func() {
 			defer func() {
-				self.Peers[connId].Close()
+				peer.Close()
 				self.Closed <- connId
 			}()
-			self.handle(self.Peers[connId])
+			self.handle(peer)
 		}()
 	}
 }
@@ -239,6 +270,8 @@ func (self *Server) handle(peer *Peer) {
 			err = peer.onCmdQuery(&cmdPacket)
 		case mysql.COM_BINLOG_DUMP:
 			err = peer.onCmdBinlogDump(&cmdPacket)
+		case mysql.COM_BINLOG_DUMP_GTID:
+			err = peer.onCmdBinlogDumpGtid(&cmdPacket)
 		case mysql.COM_PING:
 			err = peer.onCmdPing(&cmdPacket)
 		case mysql.COM_QUIT:
@@ -252,6 +285,10 @@ func (self *Server) handle(peer *Peer) {
 		if err != nil {
 			fmt.Println(err.Error())
 		}
+		if cmdPacket.Type == mysql.COM_BINLOG_DUMP || cmdPacket.Type == mysql.COM_BINLOG_DUMP_GTID {
+			// the connection ends with the dump as mysqld does, semisync acks may still be read from it
+			return
+		}
 		reader := cmdPacket.GetReader(peer.Conn, peer.Buffer[:])
 		io.Copy(ioutil.Discard, &reader)
 	}
@@ -266,8 +303,15 @@ func (peer *Peer) SendOk(seq byte) (err error) {
 
 func (peer *Peer) onCmdRegisterSlave(cmdPacket *mysql.BaseCommandPacket) (err error) {
 	regSlave := mysql.ComRegisterSlave{}
-	regSlave.FromBuffer(peer.Buffer[:cmdPacket.PacketLength])
+	if _, err = regSlave.FromBuffer(peer.Buffer[:cmdPacket.PacketLength]); err != nil {
+		errPacket := mysql.BuildErrPacket(mysql.ER_MALFORMED_PACKET)
+		errPacket.PacketSeq = cmdPacket.PacketSeq + 1
+		return mysql.WritePacketTo(&errPacket, peer.Conn, peer.Buffer[:])
+	}
 	peer.ClientServerId = regSlave.ServerId
+	peer.stateLock.Lock()
+	peer.registration = &regSlave
+	peer.stateLock.Unlock()
 	return peer.SendOk(cmdPacket.PacketSeq + 1)
 	return
 }
@@ -277,32 +321,128 @@ func (peer *Peer) onCmdBinlogDump(cmdPacket *mysql.BaseCommandPacket) (err error
 
 	dump := mysql.ComBinglogDump{}
 	dump.FromBuffer(peer.Buffer[:cmdPacket.PacketLength])
+	peer.seq = cmdPacket.PacketSeq + 1
 	relay := peer.GetRelay()
+	if relay == nil {
+		return peer.sendBinlogError("Binary log is not open")
+	}
 	fmt.Printf("peer %s: dump from %s:%d\n", peer.RemoteAddr(), dump.BinlogFilename, dump.BinlogPos)
-	currentIndex := relay.FindIndex(dump.BinlogFilename)
+	name := dump.BinlogFilename
+	if name == "" {
+		// from the first binlog, as MySQL does
+		if binlogs := relay.ListBinlogs(); len(binlogs) > 0 {
+			name = binlogs[0].Name
+		}
+	}
+	// recorded before the binlog is checked and opened, the purger keeps it from now on
+	peer.setSendingPosition(name, dump.BinlogPos)
+	defer peer.setSendingPosition("", 0)
+	currentIndex := relay.FindIndex(name)
 	if currentIndex < 0 {
-		// binlog not exists
 		fmt.Printf("peer %s: binlog not exists\n", peer.RemoteAddr())
-		// TODO: wait for binlog
-		// TODO: return error code
+		return peer.sendBinlogError("Could not find first log file name in binary log index file")
+	}
+	if dump.BinlogPos < mysql.LOG_POS_START {
+		return peer.sendBinlogError("Client requested master to start replication from position < 4")
+	}
+	if dump.BinlogPos > relay.BinlogInfoByIndex(currentIndex).Size {
+		return peer.sendBinlogError("Client requested master to start replication from position > file size")
+	}
+	atEvent, before, after, err := relay.CheckEventBoundary(currentIndex, dump.BinlogPos)
+	util.Assert0(err)
+	if !atEvent {
+		return peer.sendBinlogError(fmt.Sprintf("Client requested master to start replication from position %d "+
+			"which is not the start of an event in '%s'; the nearest events start at %d and %d",
+			dump.BinlogPos, relay.NameByIndex(currentIndex), before, after))
+	}
+	return peer.dumpBinlog(relay, currentIndex, dump.BinlogPos)
+}
+
+func (peer *Peer) onCmdBinlogDumpGtid(cmdPacket *mysql.BaseCommandPacket) (err error) {
+	defer util.RecoverToError(&err)
+
+	peer.seq = cmdPacket.PacketSeq + 1
+	// the gtid set may be larger than Buffer, which holds only the head of the packet
+	body := make([]byte, cmdPacket.PacketLength)
+	cmdPacket.Pos = 0
+	reader := cmdPacket.GetReader(peer.Conn, peer.Buffer[:])
+	_ = util.Assert1(io.ReadFull(&reader, body))
+	dump := mysql.ComBinlogDumpGtid{}
+	_ = util.Assert1(dump.FromBuffer(body))
+	relay := peer.GetRelay()
+	if relay == nil {
+		return peer.sendBinlogError("Binary log is not open")
+	}
+	fmt.Printf("peer %s: dump from gtid set %s\n", peer.RemoteAddr(), dump.Gtids.String())
+	// binlogs are kept from the first while the start is searched
+	if binlogs := relay.ListBinlogs(); len(binlogs) > 0 {
+		peer.setSendingPosition(binlogs[0].Name, mysql.LOG_POS_START)
+	}
+	defer peer.setSendingPosition("", 0)
+	currentIndex, currentPos, err := relay.FindGtidStart(dump.Gtids)
+	util.Assert0(err)
+	if currentIndex < 0 {
+		fmt.Printf("peer %s: binlogs containing gtids required are purged\n", peer.RemoteAddr())
+		return peer.sendBinlogError(mysql.SERVER_ERR_MESSAGES[mysql.ER_MASTER_HAS_PURGED_REQUIRED_GTIDS])
+	}
+	peer.skipGtids = dump.Gtids
+	peer.skipping = false
+	fmt.Printf("peer %s: start at %s:%d\n", peer.RemoteAddr(), relay.NameByIndex(currentIndex), currentPos)
+	return peer.dumpBinlog(relay, currentIndex, currentPos)
+}
+
+// an error reading binlog while dumping, sent to the peer with the message as MySQL does
+type binlogReadError string
+
+func (self binlogReadError) Error() string {
+	return string(self)
+}
+
+// ER_MASTER_FATAL_ERROR_READING_BINLOG ends the dump, after events buffered while dumping
+func (peer *Peer) sendBinlogError(message string) (err error) {
+	fmt.Printf("peer %s: %s\n", peer.RemoteAddr(), message)
+	errPacket := mysql.BuildErrPacketWithMessage(mysql.ER_MASTER_FATAL_ERROR_READING_BINLOG, message)
+	errPacket.PacketSeq = peer.seq
+	peer.seq++
+	if peer.out != nil {
+		if err = mysql.WritePacketTo(&errPacket, peer.out, peer.Buffer[:]); err == nil {
+			err = peer.out.Flush()
+		}
 		return
 	}
-	currentPos := dump.BinlogPos
+	err = mysql.WritePacketTo(&errPacket, peer.Conn, peer.Buffer[:])
+	return
+}
+
+func (peer *Peer) dumpBinlog(relay *relay.BinlogRelay, currentIndex int, currentPos uint32) (err error) {
+	defer func() {
+		if readErr, ok := err.(binlogReadError); ok {
+			peer.sendBinlogError(readErr.Error())
+		}
+	}()
+	defer util.RecoverToError(&err)
+	peer.dumpStartName, peer.dumpStartPos = relay.NameByIndex(currentIndex), currentPos
+
 	relayIndex, relayPos := relay.CurrentPosition()
-	peer.seq = cmdPacket.PacketSeq + 1
 	// TODO: check for last pos
+	peer.out = bufio.NewWriterSize(countingWriter{peer.Conn, &peer.bytesSent}, PEER_WRITE_BUFFER_SIZE)
+	go peer.readWhileDumping()
+	defer peer.setSendingPosition("", 0)
 
-	var delayer util.AutoDelayer
 	var file *os.File
 	for {
 		binlog := relay.BinlogInfoByIndex(currentIndex)
+		peer.setSendingPosition(binlog.Name, currentPos)
 		if file != nil {
 			fmt.Printf("peer %s: close %s\n", peer.RemoteAddr(), file.Name())
 			file.Close()
 		}
 		currentFilePath := relay.NameToPath(binlog.Name)
 		fmt.Printf("peer %s: open %s\n", peer.RemoteAddr(), currentFilePath)
-		file = util.Assert1(os.Open(currentFilePath)).(*os.File)
+		if file, err = os.Open(currentFilePath); err != nil {
+			fmt.Printf("peer %s: %s\n", peer.RemoteAddr(), err.Error())
+			return binlogReadError("Could not open log file")
+		}
 		fmt.Printf("peer %s: send fake RotateEvent\n", peer.RemoteAddr())
 		util.Assert0(peer.sendFakeRotateEvent(relay.NameByIndex(currentIndex), uint64(currentPos)))
 		endPos := binlog.Size
@@ -312,6 +452,7 @@ func (peer *Peer) onCmdBinlogDump(cmdPacket *mysql.BaseCommandPacket) (err error
 		}
 		for {
 			util.Assert0(peer.sendBinlog(file, currentPos, endPos))
+			peer.setSendingPosition(binlog.Name, endPos)
 			if currentIndex < relayIndex {
 				break // not last file
 			}
@@ -319,7 +460,7 @@ func (peer *Peer) onCmdBinlogDump(cmdPacket *mysql.BaseCommandPacket) (err error
 			relayIndex, relayPos = relay.CurrentPosition()
 			for currentIndex == relayIndex && currentPos >= relayPos {
 				//fmt.Printf("Waiting for update (%d, %d)!\n", relayIndex, relayPos)
-				delayer.Delay()
+				util.Assert0(peer.waitForEvents(relay, relayIndex, relayPos, binlog.Name, currentPos))
 				relayIndex, relayPos = relay.CurrentPosition()
 			}
 			currentSize := relay.BinlogInfoByIndex(currentIndex).Size
@@ -336,107 +477,186 @@ func (peer *Peer) onCmdBinlogDump(cmdPacket *mysql.BaseCommandPacket) (err error
 
 func (peer *Peer) sendFakeRotateEvent(name string, position uint64) (err error) {
 	fakeRotateEvent := mysql.RotateEvent{Name: name, Position: position}
-	packet := fakeRotateEvent.BuildFakePacket(peer.Server.Server.ServerId)
+	packet := fakeRotateEvent.BuildFakePacket(peer.Server.Server.ServerId, peer.wantChecksum())
 	fmt.Println("fake rotate event: " + packet.String())
 	packet.PacketSeq = peer.seq
+	if peer.semisync {
+		packet.Semisync = mysql.SEMISYNC_SKIP
+	}
 	peer.seq++
-	err = mysql.WritePacketTo(&packet, peer.Conn, peer.Buffer[:])
+	err = mysql.WritePacketTo(&packet, peer.out, peer.Buffer[:])
 	return
 }
 
+// a peer sends nothing but semisync acks while dumping, it is closed once the connection ends
+func (peer *Peer) readWhileDumping() {
+	defer peer.Close()
+	if peer.semisync {
+		peer.readSemisyncAcks()
+		return
+	}
+	io.Copy(ioutil.Discard, peer.Conn)
+}
+
+// wait for the relay to move from (index, pos), sending heartbeats of name:sentPos while the relay runs.
+// returns PEER_CLOSED if the peer is closed
+func (peer *Peer) waitForEvents(relay *relay.BinlogRelay, index int, pos uint32, name string, sentPos uint32) (err error) {
+	changed := relay.PositionChanged(index, pos)
+	var timer *time.Timer
+	var heartbeat <-chan time.Time
+	if peer.heartbeat > 0 {
+		timer = time.NewTimer(peer.heartbeat)
+		defer timer.Stop()
+		heartbeat = timer.C
+	}
+	for {
+		select {
+		case <-changed:
+			return
+		case <-peer.Done():
+			return PEER_CLOSED
+		case <-heartbeat:
+			// not while upstream is lost, so the peer times out and reconnects as it would with a dead master
+			if relay.Running() {
+				if err = peer.sendHeartbeatEvent(name, sentPos); err != nil {
+					return
+				}
+			}
+			timer.Reset(peer.heartbeat)
+		}
+	}
+}
+
+func (peer *Peer) sendHeartbeatEvent(name string, pos uint32) (err error) {
+	heartbeat := mysql.HeartbeatEvent{Name: name}
+	packet := heartbeat.BuildPacket(peer.Server.Server.ServerId, pos, peer.wantChecksum())
+	packet.PacketSeq = peer.seq
+	if peer.semisync {
+		packet.Semisync = mysql.SEMISYNC_SKIP
+	}
+	peer.seq++
+	if err = mysql.WritePacketTo(&packet, peer.out, peer.Buffer[:]); err != nil {
+		return
+	}
+	return peer.out.Flush()
+}
+
 func (peer *Peer) sendFakeFormatDescriptionEvent(file *os.File) (err error) {
-	file.Seek(mysql.LOG_POS_START, 0)
-	peer.Buffer[4] = '\x00'
-	_, err = file.Read(peer.Buffer[5 : mysql.BinlogEventHeaderSize+5])
+	peer.Buffer[0] = '\x00'
+	_, err = file.ReadAt(peer.Buffer[1:mysql.BinlogEventHeaderSize+1], mysql.LOG_POS_START)
 	if err != nil {
 		fmt.Printf("read fde failed: %s\n", err.Error())
 		return
 	}
 	var event mysql.BinlogEventPacket
-	event.FromBuffer(peer.Buffer[4:])
-
+	event.FromBuffer(peer.Buffer[:])
 	if event.EventType != mysql.FORMAT_DESCRIPTION_EVENT {
 		err = fmt.Errorf("Not a FORMAT_DESCRIPTION_EVENT")
 		return
 	}
-
 	fmt.Println("fde read: " + event.String())
-	_, err = file.Read(peer.Buffer[mysql.BinlogEventHeaderSize+5 : event.EventSize+5])
-	if err != nil {
-		return
-	}
-	//fmt.Printf("buffer: %v\n", peer.Buffer[:event.EventSize+5])
-	event.PacketHeader = mysql.PacketHeader{PacketLength: event.EventSize + 1, PacketSeq: peer.seq}
-	event.BodyLength = int(event.EventSize + 1 - mysql.BinlogEventHeaderSize)
 	event.LogPos = 0
-	event.ToBuffer(peer.Buffer[4:])
-	mysql.ENDIAN.PutUint32(peer.Buffer[:], event.PacketHeader.ToUint32())
-
-	var fde mysql.FormatDescriptionEvent
-	err = fde.Parse(&event, peer.Buffer[5:])
-	if err != nil {
-		fmt.Println("parse fde failed! %s\n", err.Error())
-		return
-	}
-	fmt.Printf("FDE: %v\n", fde)
-
-	if fde.ChecksumAlgorism == 1 {
-		//rewrite checksum!
-		checksum := crc32.ChecksumIEEE(peer.Buffer[5 : event.EventSize+1])
-		fmt.Printf("fake fde: rewrite checksum of %v == %08x\n", peer.Buffer[5:event.EventSize+1], checksum)
-		mysql.ENDIAN.PutUint32(peer.Buffer[event.EventSize+1:], checksum)
+	_, _ = event.ToBuffer(peer.Buffer[:])
+	if peer.semisync {
+		event.Semisync = mysql.SEMISYNC_SKIP
 	}
-
-	fmt.Printf("fde packet: %v!!!!!!!\n", peer.Buffer[:event.PacketLength+4])
-	peer.Conn.Write(peer.Buffer[:event.PacketLength+4])
+	event.PacketSeq = peer.seq
 	peer.seq++
+	err = peer.sendFormatDescriptionEvent(&event, io.NewSectionReader(file, mysql.LOG_POS_START+mysql.BinlogEventHeaderSize, int64(event.EventSize)), mysql.BinlogEventHeaderSize+1)
 	return
 }
 
 func (peer *Peer) sendBinlog(file *os.File, from uint32, to uint32) (err error) {
 	defer util.RecoverToError(&err)
+	defer func() {
+		if flushErr := peer.out.Flush(); err == nil {
+			err = flushErr
+		}
+	}()
 
 	//fmt.Printf("peer %s: send %d:%d\n", peer.RemoteAddr(), from, to)
 	if from >= to {
 		return
 	}
-	file.Seek(int64(from), 0)
-	var n int64
+	_ = util.Assert1(file.Seek(int64(from), 0))
 	pos := from
-	peer.Buffer[0] = '\x00'
-	for {
-		_ = util.Assert1(file.Read(peer.Buffer[1 : mysql.BinlogEventHeaderSize+1]))
+	for pos < to {
+		if peer.sendsAsIs() {
+			pos = util.Assert1(peer.sendEventsAsIs(file, pos, to)).(uint32)
+			if pos >= to {
+				break
+			}
+			_ = util.Assert1(file.Seek(int64(pos), 0))
+		}
+		peer.Buffer[0] = '\x00'
+		_ = util.Assert1(io.ReadFull(file, peer.Buffer[1:mysql.BinlogEventHeaderSize+1]))
 		var event mysql.BinlogEventPacket
 		event.FromBuffer(peer.Buffer[:])
 		event.PacketLength = event.EventSize + 1 //
-		event.PacketSeq = peer.seq
+		event.BodyLength = int(event.PacketLength) - mysql.BinlogEventHeaderSize - 1
+		event.HasChecksum = peer.fileChecksum
 
-		peer.seq++
 		fmt.Println("event: " + event.String())
-		if event.LogPos-event.EventSize != pos {
-			err = fmt.Errorf("bad pos: pos: %d, LogPos: %d, EventSize: %d", pos, event.LogPos, event.EventSize) //mysql.BuildErrPacket(mysql.ER_BINLOG_LOGGING_IMPOSSIBLE, "")
-			// TODO: output mysql error pkt
+		if err = peer.checkEventPos(&event, file, pos); err != nil {
 			return
 		}
-		util.Assert0(event.Reset(false))
-		reader := event.GetReader(file, peer.Buffer[:mysql.BinlogEventHeaderSize+1])
-		reader.WithProtocolHeader = true
-		n, err = io.Copy(peer.Conn, &reader)
-		//fmt.Printf("%d bytes sent to peer\n", n)
-
-		// TODO: validate checksum
-		pos += uint32(event.EventSize) // n-5
-		if err != nil {
-			fmt.Println(err.Error())
-		}
-		if n == 0 {
-			return
+		buffered := mysql.BinlogEventHeaderSize + 1
+		if peer.skipGtids != nil {
+			var skip bool
+			skip, buffered = peer.skipEvent(&event, file)
+			if skip {
+				pos += event.EventSize
+				_ = util.Assert1(file.Seek(int64(pos), 0))
+				continue
+			}
 		}
-		if pos >= to {
-			return
+		if peer.semisync {
+			var ends bool
+			ends, buffered, err = peer.endsTransaction(&event, file, buffered)
+			util.Assert0(err)
+			event.Semisync = mysql.SEMISYNC_SKIP
+			if ends {
+				event.Semisync = mysql.SEMISYNC_ACK
+			}
 		}
+		event.PacketSeq = peer.seq
+		peer.seq++
+		util.Assert0(peer.sendEvent(&event, file, buffered))
+		pos += event.EventSize
+	}
+	return
+}
 
+// the event read at pos of binlog should end at its LogPos
+func (peer *Peer) checkEventPos(event *mysql.BinlogEventPacket, file *os.File, pos uint32) error {
+	if event.LogPos-event.EventSize != pos || event.EventSize < mysql.BinlogEventHeaderSize {
+		fmt.Printf("peer %s: bad pos: pos: %d, LogPos: %d, EventSize: %d\n", peer.RemoteAddr(), pos, event.LogPos, event.EventSize)
+		return binlogReadError(fmt.Sprintf("bogus data in log event; the first event '%s' at %d, "+
+			"the last event read from '%s' at %d, the last byte read from '%s' at %d.",
+			peer.dumpStartName, peer.dumpStartPos, file.Name(), pos, file.Name(), pos+mysql.BinlogEventHeaderSize))
+	}
+	return nil
+}
+
+// whether the event belongs to a transaction the peer already has.
+// the body of GTID_EVENT is read to buffer, buffered is bytes of event in buffer
+func (peer *Peer) skipEvent(event *mysql.BinlogEventPacket, file *os.File) (skip bool, buffered int) {
+	buffered = mysql.BinlogEventHeaderSize + 1
+	switch event.EventType {
+	case mysql.GTID_EVENT:
+		if int(event.PacketLength) <= len(peer.Buffer) {
+			_ = util.Assert1(io.ReadFull(file, peer.Buffer[buffered:event.PacketLength]))
+			buffered = int(event.PacketLength)
+			var gtidEvent mysql.GtidEvent
+			util.Assert0(gtidEvent.Parse(event, peer.Buffer[:]))
+			peer.skipping = peer.skipGtids.ContainsGtid(gtidEvent.Gtid)
+		}
+	case mysql.ANONYMOUS_GTID_EVENT:
+		peer.skipping = false
+	case mysql.FORMAT_DESCRIPTION_EVENT, mysql.ROTATE_EVENT, mysql.PREVIOUS_GTIDS_EVENT, mysql.STOP_EVENT:
+		return
 	}
+	skip = peer.skipping
 	return
 }
 
@@ -0,0 +1,228 @@
+package server
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"mysql_relay/mysql"
+	"mysql_relay/relay"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// a server relaying upstream u1 from binlogs of dir, and a peer of user repl connected to it
+func newTestPeer(t *testing.T, dir string, binlog []byte) (peer *Peer, downstream net.Conn) {
+	if err := ioutil.WriteFile(dir+"/log-bin.000001", binlog, 0644); err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{}
+	s.Config.Users = map[string]UserConfig{"repl": {Upstream: "u1"}}
+	s.Init()
+	r := new(relay.BinlogRelay)
+	if err := r.Init("u1", mysql.Client{}, dir, "log-bin.000001"); err != nil {
+		t.Fatal(err)
+	}
+	s.setUpstream("u1", r)
+	return connectTestPeer(t, s)
+}
+
+func connectTestPeer(t *testing.T, s *Server) (peer *Peer, downstream net.Conn) {
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+	if downstream, err = net.Dial("tcp", listen.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := listen.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer = &Peer{Conn: conn, Server: s, User: "repl", checksum: "CRC32"}
+	return
+}
+
+// dump in background, the error of the dump is sent to the channel returned
+func startTestDump(peer *Peer, name string, pos uint32) <-chan error {
+	dump := mysql.ComBinglogDump{BinlogFilename: name, BinlogPos: pos}
+	n, _ := dump.ToBuffer(peer.Buffer[:])
+	ended := make(chan error, 1)
+	go func() {
+		ended <- peer.onCmdBinlogDump(&mysql.BaseCommandPacket{PacketHeader: mysql.PacketHeader{PacketLength: uint32(n)}})
+	}()
+	return ended
+}
+
+func readTestEvent(conn net.Conn, timeout time.Duration) (event mysql.BinlogEventPacket, err error) {
+	buffer := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	header, err := mysql.ReadPacketHeader(conn)
+	if err == nil {
+		err = mysql.ReadPacket(header, conn, buffer)
+	}
+	if err != nil {
+		return
+	}
+	event.PacketHeader = header
+	event.FromBuffer(buffer)
+	return
+}
+
+func TestWaitingPeerDisconnected(t *testing.T) {
+	dir, err := ioutil.TempDir("", "peer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	binlog := append([]byte{'\xfe', 'b', 'i', 'n'}, buildTestFormatDescription()...)
+	peer, downstream := newTestPeer(t, dir, binlog)
+	defer peer.Close()
+
+	ended := startTestDump(peer, "log-bin.000001", uint32(len(binlog)))
+	for i := 0; i < 100; i++ {
+		if name, _ := peer.SendingPosition(); name != "" {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	downstream.Close()
+	select {
+	case err = <-ended:
+		if err != PEER_CLOSED {
+			t.Errorf("dump ended with %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("peer still waiting after disconnected")
+	}
+	if name, _ := peer.SendingPosition(); name != "" {
+		t.Errorf("still sending %s", name)
+	}
+}
+
+func TestDumpGtidLargerThanBuffer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "peer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	binlog := append([]byte{'\xfe', 'b', 'i', 'n'}, buildTestFormatDescription()...)
+	peer, downstream := newTestPeer(t, dir, binlog)
+	defer peer.Close()
+	defer downstream.Close()
+
+	dump := mysql.ComBinlogDumpGtid{Flags: mysql.BINLOG_THROUGH_GTID, Gtids: mysql.NewGtidSet()}
+	for i := 0; i < 64; i++ {
+		dump.Gtids.Add(mysql.Gtid{Sid: mysql.Sid{byte(i), 1}, Gno: 1})
+	}
+	body := make([]byte, 4096)
+	n, err := dump.ToBuffer(body)
+	if err != nil || n <= len(peer.Buffer) {
+		t.Fatalf("%d bytes, %v", n, err)
+	}
+	// the head is read to Buffer with the header, the rest is still in the connection
+	copy(peer.Buffer[:], body)
+	go downstream.Write(body[len(peer.Buffer):n])
+	ended := make(chan error, 1)
+	go func() {
+		ended <- peer.onCmdBinlogDumpGtid(&mysql.BaseCommandPacket{PacketHeader: mysql.PacketHeader{PacketLength: uint32(n)}})
+	}()
+	for _, eventType := range []byte{mysql.ROTATE_EVENT, mysql.FORMAT_DESCRIPTION_EVENT} {
+		if event, err := readTestEvent(downstream, time.Second); err != nil || event.EventType != eventType {
+			t.Fatalf("got %s, %v", event.String(), err)
+		}
+	}
+	downstream.Close()
+	if err = <-ended; err != PEER_CLOSED {
+		t.Errorf("dump ended with %v", err)
+	}
+}
+
+func TestWriteResultSet(t *testing.T) {
+	peer, downstream := connectTestPeer(t, &Server{})
+	defer peer.Close()
+	defer downstream.Close()
+	cols := []mysql.ColumnDefinition{stringColumn("Executed_Gtid_Set", 65535), unsignedColumn("Position")}
+	large := strings.Repeat("x", 4*PEER_BUFFER_SIZE)
+	written := make(chan error, 1)
+	go func() {
+		written <- writeResultSet(peer, cols, [][]mysql.Value{
+			{mysql.StringValue(large), mysql.StringValue("4")},
+			{mysql.StringValue(""), mysql.StringValue("5")},
+		})
+	}()
+	cursor := mysql.Cursor{ReadWriter: downstream, Buffer: make([]byte, 8*PEER_BUFFER_SIZE)}
+	if err := cursor.BeginRead(); err != nil {
+		t.Fatal(err)
+	}
+	resultSet, _ := cursor.ToRecordSet()
+	if len(resultSet.Columns) != 2 || len(resultSet.Rows) != 2 {
+		t.Fatalf("%d columns, %d rows", len(resultSet.Columns), len(resultSet.Rows))
+	}
+	if resultSet.Rows[0].Values[0].Value != large || resultSet.Rows[1].Values[1].Value != "5" {
+		t.Errorf("rows not as written")
+	}
+	if err := <-written; err != nil {
+		t.Error(err)
+	}
+
+	peer.Conn.Close()
+	if err := writeResultSet(peer, cols, nil); err == nil {
+		t.Error("write error not returned")
+	}
+}
+
+func TestGtidModeWhileUpstreamDown(t *testing.T) {
+	dir, err := ioutil.TempDir("", "peer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	binlog := append([]byte{'\xfe', 'b', 'i', 'n'}, buildTestFormatDescription()...)
+	peer, downstream := newTestPeer(t, dir, binlog)
+	defer peer.Close()
+	defer downstream.Close()
+	// never connected to upstream
+	peer.GetRelay().SetGtidMode(true)
+
+	query := "select @@global.gtid_mode"
+	copy(peer.Buffer[1:], query)
+	go peer.onCmdQuery(&mysql.BaseCommandPacket{PacketHeader: mysql.PacketHeader{PacketLength: uint32(1 + len(query))}})
+	downstream.SetReadDeadline(time.Now().Add(time.Second))
+	cursor := mysql.Cursor{ReadWriter: downstream, Buffer: make([]byte, PEER_BUFFER_SIZE)}
+	if err = cursor.BeginRead(); err != nil {
+		t.Fatal(err)
+	}
+	resultSet, _ := cursor.ToRecordSet()
+	if len(resultSet.Rows) != 1 || resultSet.Rows[0].Values[0].Value != "ON" {
+		t.Errorf("gtid_mode %v", resultSet.Rows)
+	}
+}
+
+func TestAdminToken(t *testing.T) {
+	s := &Server{}
+	s.Config.Server.AdminToken = "secret"
+	s.Init()
+	for _, c := range []struct {
+		method, authorization string
+		status                int
+	}{
+		{"POST", "", http.StatusUnauthorized},
+		{"POST", "Bearer wrong", http.StatusUnauthorized},
+		{"POST", "Bearer secret", http.StatusNotFound},
+		{"GET", "", http.StatusNotFound},
+	} {
+		r := httptest.NewRequest(c.method, "/upstreams/u1/stop", nil)
+		if c.authorization != "" {
+			r.Header.Set("Authorization", c.authorization)
+		}
+		w := httptest.NewRecorder()
+		s.onAdminUpstream(w, r)
+		if w.Code != c.status {
+			t.Errorf("%s with %q: status %d", c.method, c.authorization, w.Code)
+		}
+	}
+}
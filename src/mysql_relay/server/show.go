@@ -0,0 +1,235 @@
+package server
+
+import (
+	"mysql_relay/mysql"
+	"net"
+	"regexp"
+	"strconv"
+)
+
+var showSlaveStatusRegEx = regexp.MustCompile(`(?i)^\s*show\s+(slave|replica)\s+status(?:\s+for\s+channel\s+'([^']*)')?\s*;?\s*$`)
+
+func stringColumn(name string, length uint32) mysql.ColumnDefinition {
+	return mysql.ColumnDefinition{
+		Catalog:      "def",
+		Name:         name,
+		OrgName:      name,
+		Decimals:     31,
+		CharacterSet: mysql.UTF8_GENERAL_CI,
+		Type:         mysql.MYSQL_TYPE_VAR_STRING,
+		ColumnLength: length,
+	}
+}
+
+func unsignedColumn(name string) mysql.ColumnDefinition {
+	return mysql.ColumnDefinition{
+		Catalog:      "def",
+		Name:         name,
+		OrgName:      name,
+		Decimals:     0,
+		CharacterSet: mysql.BINARY,
+		Type:         mysql.MYSQL_TYPE_LONGLONG,
+		ColumnLength: 20,
+		Flags:        mysql.COL_DEF_NOT_NULL | mysql.COL_DEF_UNSIGNED,
+	}
+}
+
+func writeResultSet(peer *Peer, cols []mysql.ColumnDefinition, rows [][]mysql.Value) (err error) {
+	cursor := mysql.Cursor{
+		Columns:    cols,
+		ReadWriter: peer.Conn,
+		Buffer:     peer.Buffer[:],
+	}
+	err = cursor.BeginWrite()
+	if err != nil {
+		return
+	}
+	for _, row := range rows {
+		cursor.Rows <- mysql.ResultRow{Values: row}
+	}
+	return cursor.EndWrite()
+}
+
+// SHOW BINARY LOGS of the upstream of the user
+func showBinaryLogs(peer *Peer) (err error) {
+	cols := []mysql.ColumnDefinition{
+		stringColumn("Log_name", 255),
+		unsignedColumn("File_size"),
+	}
+	rows := make([][]mysql.Value, 0, 16)
+	if relay := peer.GetRelay(); relay != nil {
+		for _, binlog := range relay.ListBinlogs() {
+			rows = append(rows, []mysql.Value{
+				mysql.StringValue(binlog.Name),
+				mysql.StringValue(strconv.FormatUint(uint64(binlog.Size), 10)),
+			})
+		}
+	}
+	return writeResultSet(peer, cols, rows)
+}
+
+// SHOW MASTER STATUS, with the gtids relayed as executed
+func showMasterStatus(peer *Peer) (err error) {
+	cols := []mysql.ColumnDefinition{
+		stringColumn("File", 255),
+		unsignedColumn("Position"),
+		stringColumn("Binlog_Do_DB", 255),
+		stringColumn("Binlog_Ignore_DB", 255),
+		stringColumn("Executed_Gtid_Set", 65535),
+	}
+	rows := make([][]mysql.Value, 0, 1)
+	if relay := peer.GetRelay(); relay != nil && len(relay.ListBinlogs()) > 0 {
+		index, pos := relay.CurrentPosition()
+		rows = append(rows, []mysql.Value{
+			mysql.StringValue(relay.NameByIndex(index)),
+			mysql.StringValue(strconv.FormatUint(uint64(pos), 10)),
+			mysql.StringValue(""),
+			mysql.StringValue(""),
+			mysql.StringValue(relay.RetrievedGtids().String()),
+		})
+	}
+	return writeResultSet(peer, cols, rows)
+}
+
+// SHOW SLAVE HOSTS, replicas registered to the upstream of the user and still connected
+func showSlaveHosts(peer *Peer, replicas bool) (err error) {
+	names := []string{"Server_id", "Host", "Port", "Master_id", "Slave_UUID"}
+	if replicas {
+		names = []string{"Server_Id", "Host", "Port", "Source_Id", "Replica_UUID"}
+	}
+	cols := []mysql.ColumnDefinition{
+		unsignedColumn(names[0]),
+		stringColumn(names[1], 255),
+		unsignedColumn(names[2]),
+		unsignedColumn(names[3]),
+		stringColumn(names[4], 36),
+	}
+	upstream := peer.Server.Config.Users[peer.User].Upstream
+	masterId := strconv.FormatUint(uint64(peer.Server.Config.Server.ServerId), 10)
+	rows := make([][]mysql.Value, 0, 8)
+	for _, other := range peer.Server.PeerList() {
+		if user, ok := peer.Server.Config.Users[other.User]; !ok || user.Upstream != upstream {
+			continue
+		}
+		other.stateLock.Lock()
+		registration, uuid := other.registration, other.slaveUuid
+		other.stateLock.Unlock()
+		if registration == nil {
+			continue
+		}
+		rows = append(rows, []mysql.Value{
+			mysql.StringValue(strconv.FormatUint(uint64(registration.ServerId), 10)),
+			mysql.StringValue(registration.Hostname),
+			mysql.StringValue(strconv.FormatUint(uint64(registration.Port), 10)),
+			mysql.StringValue(masterId),
+			mysql.StringValue(uuid),
+		})
+	}
+	return writeResultSet(peer, cols, rows)
+}
+
+// SHOW SLAVE STATUS [FOR CHANNEL 'upstream'], a row for each upstream with channel name of it
+func showSlaveStatus(peer *Peer, cmdPacket *mysql.BaseCommandPacket) (err error) {
+	query := string(peer.Buffer[1:cmdPacket.PacketLength])
+	match := showSlaveStatusRegEx.FindStringSubmatch(query)
+	if match == nil {
+		errPacket := mysql.BuildErrPacket(mysql.ER_NOT_SUPPORTED_YET, "this")
+		errPacket.PacketSeq = cmdPacket.PacketSeq + 1
+		return mysql.WritePacketTo(&errPacket, peer.Conn, peer.Buffer[:])
+	}
+	cols := []mysql.ColumnDefinition{
+		stringColumn("Slave_IO_State", 64),
+		stringColumn("Master_Host", 255),
+		stringColumn("Master_User", 96),
+		unsignedColumn("Master_Port"),
+		unsignedColumn("Connect_Retry"),
+		stringColumn("Master_Log_File", 512),
+		unsignedColumn("Read_Master_Log_Pos"),
+		stringColumn("Relay_Log_File", 512),
+		unsignedColumn("Relay_Log_Pos"),
+		stringColumn("Relay_Master_Log_File", 512),
+		stringColumn("Slave_IO_Running", 3),
+		stringColumn("Slave_SQL_Running", 3),
+		unsignedColumn("Exec_Master_Log_Pos"),
+		unsignedColumn("Relay_Log_Space"),
+		unsignedColumn("Seconds_Behind_Master"),
+		unsignedColumn("Last_IO_Errno"),
+		stringColumn("Last_IO_Error", 1024),
+		stringColumn("Last_IO_Error_Timestamp", 20),
+		stringColumn("Retrieved_Gtid_Set", 65535),
+		stringColumn("Executed_Gtid_Set", 65535),
+		unsignedColumn("Auto_Position"),
+		stringColumn("Rpl_semi_sync_slave_status", 3),
+		stringColumn("Channel_Name", 64),
+	}
+	cols[14].Flags &^= mysql.COL_DEF_NOT_NULL // Seconds_Behind_Master
+
+	rows := make([][]mysql.Value, 0, len(peer.Server.Config.Upstreams))
+	for _, name := range peer.Server.UpstreamNames() {
+		if match[2] == "" || match[2] == name {
+			rows = append(rows, peer.Server.slaveStatusRow(name))
+		}
+	}
+	return writeResultSet(peer, cols, rows)
+}
+
+func (self *Server) slaveStatusRow(name string) []mysql.Value {
+	config := self.Config.Upstreams[name]
+	status := self.upstreamStatus(name)
+	host, port, err := net.SplitHostPort(status.MasterAddr)
+	if err != nil {
+		host, port = status.MasterAddr, "3306"
+	}
+	state, running := "", "No"
+	if status.Running {
+		state, running = "Waiting for master to send event", "Yes"
+	} else if status.Connecting {
+		state, running = "Connecting to master", "Connecting"
+	}
+	behind := mysql.NullValue()
+	if status.SecondsBehindMaster >= 0 {
+		behind = mysql.StringValue(strconv.FormatInt(status.SecondsBehindMaster, 10))
+	}
+	errno, errorTime := "0", ""
+	if status.LastError != "" {
+		errno = strconv.Itoa(int(mysql.ER_MASTER_FATAL_ERROR_READING_BINLOG))
+		errorTime = status.LastErrorTime.Format("060102 15:04:05")
+	}
+	gtids := ""
+	if status.RetrievedGtids != nil {
+		gtids = status.RetrievedGtids.String()
+	}
+	autoPosition, semisync := "0", "OFF"
+	if config.AutoPosition {
+		autoPosition = "1"
+	}
+	if status.Semisync {
+		semisync = "ON"
+	}
+	u64 := func(n uint64) mysql.Value { return mysql.StringValue(strconv.FormatUint(n, 10)) }
+	return []mysql.Value{
+		mysql.StringValue(state),
+		mysql.StringValue(host),
+		mysql.StringValue(config.Username),
+		mysql.StringValue(port),
+		u64(uint64(config.RetryInterval)),
+		mysql.StringValue(status.MasterLogFile),
+		u64(status.ReadMasterLogPos),
+		mysql.StringValue(status.RelayLogFile),
+		u64(uint64(status.RelayLogPos)),
+		mysql.StringValue(status.MasterLogFile),
+		mysql.StringValue(running),
+		mysql.StringValue(running),
+		u64(status.ReadMasterLogPos),
+		u64(status.RelayLogSpace),
+		behind,
+		mysql.StringValue(errno),
+		mysql.StringValue(status.LastError),
+		mysql.StringValue(errorTime),
+		mysql.StringValue(gtids),
+		mysql.StringValue(gtids),
+		mysql.StringValue(autoPosition),
+		mysql.StringValue(semisync),
+		mysql.StringValue(name),
+	}
+}
@@ -0,0 +1,250 @@
+package server
+
+import (
+	"fmt"
+	"mysql_relay/mysql"
+	"mysql_relay/relay"
+	"mysql_relay/util"
+	"sort"
+	"sync"
+	"time"
+)
+
+// dumping of an upstream, stopped and started by admin
+type upstreamControl struct {
+	lock    sync.Mutex
+	running bool // whether the goroutine dumping is alive
+	stopped bool // stopped by admin
+	retries uint32
+
+	// before the relay is created
+	lastError     string
+	lastErrorTime time.Time
+}
+
+func (self *upstreamControl) Stopped() bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.stopped
+}
+
+func (self *upstreamControl) Retries() uint32 {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.retries
+}
+
+// whether the goroutine dumping is alive
+func (self *upstreamControl) Running() bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.running
+}
+
+func (self *upstreamControl) LastError() (message string, t time.Time) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.lastError, self.lastErrorTime
+}
+
+func (self *upstreamControl) setLastError(err error) {
+	self.lock.Lock()
+	self.lastError, self.lastErrorTime = err.Error(), time.Now()
+	self.lock.Unlock()
+}
+
+func (self *upstreamControl) setRetries(n uint32) {
+	self.lock.Lock()
+	self.retries = n
+	self.lock.Unlock()
+}
+
+// the relay dumping the upstream, nil before connected
+func (self *Server) GetUpstream(name string) *relay.BinlogRelay {
+	self.upstreamsLock.RLock()
+	defer self.upstreamsLock.RUnlock()
+	return self.Upstreams[name]
+}
+
+func (self *Server) setUpstream(name string, relay *relay.BinlogRelay) {
+	self.upstreamsLock.Lock()
+	self.Upstreams[name] = relay
+	self.upstreamsLock.Unlock()
+}
+
+// names of upstreams configured, sorted
+func (self *Server) UpstreamNames() []string {
+	names := make([]string, 0, len(self.Config.Upstreams))
+	for name := range self.Config.Upstreams {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// start dumping the upstream if not running
+func (self *Server) StartUpstream(name string) error {
+	control, ok := self.controls[name]
+	if !ok {
+		return fmt.Errorf("no upstream %s", name)
+	}
+	control.lock.Lock()
+	defer control.lock.Unlock()
+	control.stopped = false
+	if !control.running {
+		control.running = true
+		go self.runUpstream(name, control)
+	}
+	return nil
+}
+
+// stop dumping the upstream, the connection is closed
+func (self *Server) StopUpstream(name string) error {
+	control, ok := self.controls[name]
+	if !ok {
+		return fmt.Errorf("no upstream %s", name)
+	}
+	control.lock.Lock()
+	control.stopped = true
+	control.lock.Unlock()
+	if relay := self.GetUpstream(name); relay != nil {
+		relay.Disconnect()
+	}
+	return nil
+}
+
+// the relay of the upstream, created at the first start and kept across reconnections,
+// so peers dumping it go on after the upstream is switched
+func (self *Server) initUpstream(name string) (*relay.BinlogRelay, error) {
+	if relay := self.GetUpstream(name); relay != nil {
+		return relay, nil
+	}
+	upstreamConfig := self.Config.Upstreams[name]
+	relay := new(relay.BinlogRelay)
+	c := mysql.Client{ServerAddr: upstreamConfig.ServerAddr}
+	if err := relay.Init(name, c, upstreamConfig.LocalDir, upstreamConfig.StartFile); err != nil {
+		return nil, err
+	}
+	relay.SetSemisync(upstreamConfig.Semisync)
+	relay.SetGtidMode(upstreamConfig.AutoPosition)
+	relay.SetChecksumErrorPolicy(upstreamConfig.ChecksumError)
+	relay.SetNegotiateChecksum(upstreamConfig.NegotiateChecksum)
+	relay.SetRewriteServerId(upstreamConfig.RewriteServerId)
+	semisyncTimeout := upstreamConfig.SemisyncTimeout
+	if semisyncTimeout == 0 {
+		semisyncTimeout = DEFAULT_SEMISYNC_TIMEOUT
+	}
+	relay.SetSemisyncQuorum(int(upstreamConfig.SemisyncQuorum), time.Duration(semisyncTimeout)*time.Millisecond)
+	relay.SetRetentionPolicy(upstreamConfig.RetentionPolicy())
+	relay.SetHeartbeatPeriod(time.Duration(upstreamConfig.HeartbeatPeriod) * time.Second)
+	self.setUpstream(name, relay)
+	return relay, nil
+}
+
+func (self *Server) runUpstream(name string, control *upstreamControl) {
+	upstreamConfig := self.Config.Upstreams[name]
+	fmt.Println("starting " + name)
+	relay, err := self.initUpstream(name)
+	defer func() {
+		control.lock.Lock()
+		control.running = false
+		control.lock.Unlock()
+		if relay != nil {
+			relay.SetConnecting(false)
+		}
+		fmt.Println("upstram ended")
+	}()
+	if err != nil {
+		fmt.Printf("upstream %s: %s\n", name, err.Error())
+		control.setLastError(err)
+		return
+	}
+	c := mysql.Client{
+		ServerAddr: upstreamConfig.ServerAddr,
+		Username:   upstreamConfig.Username,
+		Password:   upstreamConfig.Password,
+		ServerId:   upstreamConfig.ServerId,
+	}
+	addrs := upstreamConfig.CandidateAddrs()
+	nTry := uint32(0)
+	iAddr := 0
+	connected := false
+	for !control.Stopped() {
+		control.setRetries(nTry)
+		if nTry < upstreamConfig.MaxRetryTimes {
+			c.ServerAddr = addrs[iAddr]
+			fmt.Printf("try connecting %s %d\n", c.ServerAddr, nTry)
+			if connected || nTry > 0 {
+				upstreamReconnects.With(name).Inc()
+			}
+			relay.SetConnecting(true)
+			err := c.Connect()
+			if err != nil {
+				fmt.Printf("connect %s failed: %s\n", c.ServerAddr, err.Error())
+				relay.SetLastError(err)
+				// switch to the next candidate, wait after all have failed
+				iAddr = (iAddr + 1) % len(addrs)
+				if iAddr == 0 {
+					time.Sleep(time.Duration(upstreamConfig.RetryInterval) * time.Second)
+				}
+				nTry++
+				continue
+			} else {
+				nTry = uint32(0)
+			}
+		} else {
+			break
+		}
+		fmt.Printf("connected %s\n", c.ServerAddr)
+		connected = true
+		if upstreamConfig.ReadTimeout > 0 {
+			c.Conn = util.NewTimeoutConn(c.Conn, upstreamConfig.ReadTimeout)
+		}
+		relay.SetClient(c)
+		if control.Stopped() {
+			// stopped while connecting
+			c.Conn.Close()
+			break
+		}
+		err := relay.Run()
+		if relay.Stopped() {
+			fmt.Printf("upstream %s stopped\n", name)
+			break
+		}
+		if len(addrs) > 1 && isUpstreamError(err) {
+			// the candidate refused, it may not have our gtids. a connection lost is retried on the same one
+			fmt.Printf("upstream %s: %s from %s, switch to next\n", name, err.Error(), c.ServerAddr)
+			iAddr = (iAddr + 1) % len(addrs)
+			if iAddr == 0 {
+				time.Sleep(time.Duration(upstreamConfig.RetryInterval) * time.Second)
+			}
+		}
+	}
+}
+
+// an error answered by upstream, rather than the connection lost
+func isUpstreamError(err error) bool {
+	if errs, ok := err.(util.JoinError); ok {
+		for _, e := range errs {
+			if isUpstreamError(e) {
+				return true
+			}
+		}
+		return false
+	}
+	_, ok := err.(mysql.Error)
+	return ok
+}
+
+// status of the upstream, from the relay dumping it or before connected
+func (self *Server) upstreamStatus(name string) relay.RelayStatus {
+	if relay := self.GetUpstream(name); relay != nil {
+		return relay.Status()
+	}
+	status := relay.RelayStatus{MasterAddr: self.Config.Upstreams[name].ServerAddr, SecondsBehindMaster: -1}
+	if control, ok := self.controls[name]; ok {
+		status.Connecting = control.Running() && !control.Stopped()
+		status.LastError, status.LastErrorTime = control.LastError()
+	}
+	return status
+}
@@ -0,0 +1,295 @@
+package server
+
+import (
+	"hash/crc32"
+	"io/ioutil"
+	"mysql_relay/mysql"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func buildTestEvent(eventType byte, pos uint32, body []byte) []byte {
+	return buildTestEventChecksum(eventType, pos, body, true)
+}
+
+func buildTestEventChecksum(eventType byte, pos uint32, body []byte, checksum bool) []byte {
+	size := mysql.BinlogEventHeaderSize + len(body)
+	if checksum {
+		size += 4
+	}
+	event := make([]byte, size)
+	mysql.ENDIAN.PutUint32(event, uint32(time.Now().Unix()))
+	event[4] = eventType
+	mysql.ENDIAN.PutUint32(event[5:], 1)
+	mysql.ENDIAN.PutUint32(event[9:], uint32(size))
+	mysql.ENDIAN.PutUint32(event[13:], pos+uint32(size))
+	copy(event[mysql.BinlogEventHeaderSize:], body)
+	if checksum {
+		mysql.ENDIAN.PutUint32(event[size-4:], crc32.ChecksumIEEE(event[:size-4]))
+	}
+	return event
+}
+
+func buildTestFormatDescription() []byte {
+	return buildTestFormatDescriptionAlg(mysql.BINLOG_CHECKSUM_ALG_CRC32)
+}
+
+// FORMAT_DESCRIPTION_EVENT with the checksum algorithm is always checksummed
+func buildTestFormatDescriptionAlg(alg byte) []byte {
+	body := make([]byte, 2+50+4+1+int(mysql.BINLOG_EVENT_END)+1)
+	mysql.ENDIAN.PutUint16(body, 4)
+	body[56] = mysql.BinlogEventHeaderSize
+	body[57+mysql.FORMAT_DESCRIPTION_EVENT-1] = byte(57 + mysql.BINLOG_EVENT_END)
+	body[len(body)-1] = alg
+	return buildTestEvent(mysql.FORMAT_DESCRIPTION_EVENT, mysql.LOG_POS_START, body)
+}
+
+// serve one dump as a master, sending events from the position requested, then wait for done.
+// a dump by gtids is sent all events, or refused as the gtids are purged if events is nil
+func serveTestDump(conn net.Conn, events [][]byte, done <-chan struct{}) {
+	defer conn.Close()
+	peer := &Peer{Conn: conn, Server: &Server{}}
+	handshake := mysql.BuildHandShakePacket("5.7.0", 1)
+	var auth mysql.AuthPacket
+	if mysql.WritePacketTo(&handshake, conn, peer.Buffer[:]) != nil || mysql.ReadPacketFrom(&auth, conn, peer.Buffer[:]) != nil {
+		return
+	}
+	peer.SendOk(auth.PacketSeq + 1)
+	for {
+		cmdPacket := mysql.BaseCommandPacket{}
+		if mysql.ReadPacketFrom(&cmdPacket, conn, peer.Buffer[:]) != nil {
+			return
+		}
+		switch cmdPacket.Type {
+		case mysql.COM_QUERY:
+			query := strings.ToLower(string(peer.Buffer[1:cmdPacket.PacketLength]))
+			if strings.HasPrefix(query, "select") {
+				selectVar(peer, query[len("select "):], mysql.MYSQL_TYPE_VAR_STRING, mysql.StringValue("OFF"))
+			} else {
+				peer.SendOk(cmdPacket.PacketSeq + 1)
+			}
+		case mysql.COM_BINLOG_DUMP:
+			dump := mysql.ComBinglogDump{}
+			dump.FromBuffer(peer.Buffer[:cmdPacket.PacketLength])
+			pos, seq := uint32(mysql.LOG_POS_START), byte(1)
+			for _, event := range events {
+				if pos >= dump.BinlogPos {
+					packet := []byte{byte(len(event) + 1), 0, 0, seq, 0}
+					seq++
+					if _, err := conn.Write(append(packet, event...)); err != nil {
+						return
+					}
+				}
+				pos += uint32(len(event))
+			}
+			<-done
+			return
+		case mysql.COM_BINLOG_DUMP_GTID:
+			if events == nil {
+				errPacket := mysql.BuildErrPacket(mysql.ER_MASTER_HAS_PURGED_REQUIRED_GTIDS)
+				errPacket.PacketSeq = 1
+				mysql.WritePacketTo(&errPacket, conn, peer.Buffer[:])
+				return
+			}
+			for i, event := range events {
+				packet := []byte{byte(len(event) + 1), 0, 0, byte(i + 1), 0}
+				if _, err := conn.Write(append(packet, event...)); err != nil {
+					return
+				}
+			}
+			<-done
+			return
+		}
+	}
+}
+
+// a server relaying upstream u1 from the master listening
+func startTestUpstream(t *testing.T, dir string, listen net.Listener) *Server {
+	s := &Server{}
+	s.Config.Upstreams = map[string]UpstreamConfig{"u1": {
+		LocalDir:      dir,
+		StartFile:     "log-bin.000001",
+		ServerAddr:    listen.Addr().String(),
+		MaxRetryTimes: 3,
+	}}
+	s.Config.Users = map[string]UserConfig{"repl": {Upstream: "u1"}}
+	s.Init()
+	s.controls["u1"] = new(upstreamControl)
+	s.StartUpstream("u1")
+	return s
+}
+
+// events of a binlog, FORMAT_DESCRIPTION_EVENT and XID_EVENTs
+func buildTestEvents(nXid int) [][]byte {
+	events := [][]byte{buildTestFormatDescription()}
+	pos := uint32(mysql.LOG_POS_START + len(events[0]))
+	for i := 0; i < nXid; i++ {
+		events = append(events, buildTestEvent(mysql.XID_EVENT, pos, make([]byte, 8)))
+		pos += uint32(len(events[i+1]))
+	}
+	return events
+}
+
+func waitRelayedTo(s *Server, pos uint32) {
+	var relayed uint32
+	for i := 0; i < 100 && relayed < pos; i++ {
+		time.Sleep(10 * time.Millisecond)
+		if relay := s.GetUpstream("u1"); relay != nil {
+			_, relayed = relay.CurrentPosition()
+		}
+	}
+}
+
+func TestPeerWaitingAcrossUpstreamReconnection(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upstream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+	s := startTestUpstream(t, dir, listen)
+	defer s.StopUpstream("u1")
+
+	events := buildTestEvents(2)
+	first := make(chan struct{})
+	conn, err := listen.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go serveTestDump(conn, events[:2], first)
+
+	// a peer waits at the end of the first connection
+	waitRelayedTo(s, mysql.ENDIAN.Uint32(events[1][13:]))
+	peer, downstream := connectTestPeer(t, s)
+	defer peer.Close()
+	defer downstream.Close()
+	startTestDump(peer, "log-bin.000001", mysql.LOG_POS_START)
+	for _, eventType := range []byte{mysql.ROTATE_EVENT, mysql.FORMAT_DESCRIPTION_EVENT, mysql.XID_EVENT} {
+		if event, err := readTestEvent(downstream, 2*time.Second); err != nil || event.EventType != eventType {
+			t.Fatalf("got %s, %v", event.String(), err)
+		}
+	}
+
+	// upstream fails, the relay reconnects and goes on
+	close(first)
+	if conn, err = listen.Accept(); err != nil {
+		t.Fatal(err)
+	}
+	second := make(chan struct{})
+	defer close(second)
+	go serveTestDump(conn, events, second)
+	event, err := readTestEvent(downstream, 2*time.Second)
+	if err != nil || event.EventType != mysql.XID_EVENT || event.LogPos != mysql.ENDIAN.Uint32(events[2][13:]) {
+		t.Errorf("got %s, %v after reconnection", event.String(), err)
+	}
+}
+
+func TestHeartbeatsOnlyWhileRelayRuns(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upstream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+	s := startTestUpstream(t, dir, listen)
+	defer s.StopUpstream("u1")
+
+	events := buildTestEvents(1)
+	up := make(chan struct{})
+	conn, err := listen.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go serveTestDump(conn, events, up)
+	end := mysql.ENDIAN.Uint32(events[1][13:])
+	waitRelayedTo(s, end)
+	peer, downstream := connectTestPeer(t, s)
+	defer peer.Close()
+	defer downstream.Close()
+	peer.heartbeat = 20 * time.Millisecond
+	startTestDump(peer, "log-bin.000001", end)
+	for _, eventType := range []byte{mysql.ROTATE_EVENT, mysql.FORMAT_DESCRIPTION_EVENT, mysql.HEARTBEAT_EVENT} {
+		if event, err := readTestEvent(downstream, time.Second); err != nil || event.EventType != eventType {
+			t.Fatalf("got %s, %v", event.String(), err)
+		}
+	}
+
+	// the relay stops when upstream is lost, connecting again is never answered
+	close(up)
+	for i := 0; i < 100 && s.GetUpstream("u1").Running(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	// one heartbeat may be on the way
+	readTestEvent(downstream, 50*time.Millisecond)
+	if event, err := readTestEvent(downstream, 200*time.Millisecond); err == nil {
+		t.Errorf("got %s while upstream is lost", event.String())
+	}
+}
+
+// the next connection to the master listening, nil if none in timeout
+func acceptTestUpstream(listen net.Listener, timeout time.Duration) net.Conn {
+	listen.(*net.TCPListener).SetDeadline(time.Now().Add(timeout))
+	conn, err := listen.Accept()
+	if err != nil {
+		return nil
+	}
+	return conn
+}
+
+func TestSwitchCandidateOnlyOnUpstreamError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upstream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var listens [2]net.Listener
+	for i := range listens {
+		if listens[i], err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+			t.Fatal(err)
+		}
+		defer listens[i].Close()
+	}
+	s := &Server{}
+	s.Config.Upstreams = map[string]UpstreamConfig{"u1": {
+		LocalDir:      dir,
+		StartFile:     "log-bin.000001",
+		ServerAddr:    listens[0].Addr().String(),
+		ServerAddrs:   []string{listens[1].Addr().String()},
+		AutoPosition:  true,
+		MaxRetryTimes: 3,
+	}}
+	s.Init()
+	s.controls["u1"] = new(upstreamControl)
+	s.StartUpstream("u1")
+	defer s.StopUpstream("u1")
+
+	// the connection to an idle master ends with no new gtid
+	done := make(chan struct{})
+	close(done)
+	conn := acceptTestUpstream(listens[0], 2*time.Second)
+	if conn == nil {
+		t.Fatal("not connected")
+	}
+	serveTestDump(conn, buildTestEvents(1), done)
+	if conn = acceptTestUpstream(listens[0], 2*time.Second); conn == nil {
+		t.Fatal("not connected to the same master again")
+	}
+
+	// the master refuses the dump, as it has not the gtids relayed
+	serveTestDump(conn, nil, done)
+	if conn = acceptTestUpstream(listens[1], 2*time.Second); conn == nil {
+		t.Fatal("not switched to the next candidate")
+	}
+	conn.Close()
+}
@@ -0,0 +1,28 @@
+package util
+
+import (
+	"os"
+)
+
+// write to a temp file then rename, so readers never see a partial file
+func WriteFileAtomic(path string, data []byte) (err error) {
+	tmpPath := path + ".tmp"
+	var f *os.File
+	f, err = os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return
+	}
+	err = os.Rename(tmpPath, path)
+	return
+}
@@ -0,0 +1,262 @@
+package util
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// metrics exposed in the text format of prometheus
+type Registry struct {
+	lock       sync.Mutex
+	collectors []collector
+}
+
+// the registry of metrics served on /metrics
+var Metrics Registry
+
+type collector interface {
+	collect(w io.Writer)
+}
+
+func (self *Registry) register(c collector) {
+	self.lock.Lock()
+	self.collectors = append(self.collectors, c)
+	self.lock.Unlock()
+}
+
+// write all metrics in the order registered
+func (self *Registry) WriteTo(w io.Writer) (n int64, err error) {
+	self.lock.Lock()
+	collectors := append([]collector(nil), self.collectors...)
+	self.lock.Unlock()
+	var buffer bytes.Buffer
+	for _, c := range collectors {
+		c.collect(&buffer)
+	}
+	return buffer.WriteTo(w)
+}
+
+type Counter struct {
+	value uint64
+}
+
+func (self *Counter) Add(n uint64) {
+	atomic.AddUint64(&self.value, n)
+}
+
+func (self *Counter) Inc() {
+	atomic.AddUint64(&self.value, 1)
+}
+
+func (self *Counter) Value() uint64 {
+	return atomic.LoadUint64(&self.value)
+}
+
+// cumulative histogram of observations, bounds in ascending order
+type Histogram struct {
+	lock   sync.Mutex
+	bounds []float64
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func (self *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(self.bounds, v)
+	self.lock.Lock()
+	if i < len(self.counts) {
+		self.counts[i]++
+	}
+	self.sum += v
+	self.count++
+	self.lock.Unlock()
+}
+
+// bounds of seconds for latency of disk and network
+var LatencyBuckets = []float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1}
+
+// metrics of the same name, one for each set of label values
+type metricVec struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+
+	lock     sync.Mutex
+	children map[string]interface{}
+	values   map[string][]string
+}
+
+func newMetricVec(name, help, kind string, labels []string) metricVec {
+	return metricVec{
+		name:     name,
+		help:     help,
+		kind:     kind,
+		labels:   labels,
+		children: make(map[string]interface{}),
+		values:   make(map[string][]string),
+	}
+}
+
+func (self *metricVec) child(values []string, create func() interface{}) interface{} {
+	if len(values) != len(self.labels) {
+		panic(fmt.Errorf("%s: %d label values for %d labels", self.name, len(values), len(self.labels)))
+	}
+	key := strings.Join(values, "\xff")
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	c, ok := self.children[key]
+	if !ok {
+		c = create()
+		self.children[key] = c
+		self.values[key] = append([]string(nil), values...)
+	}
+	return c
+}
+
+// remove the metric of the label values, e.g. of a peer disconnected
+func (self *metricVec) Delete(values ...string) {
+	key := strings.Join(values, "\xff")
+	self.lock.Lock()
+	delete(self.children, key)
+	delete(self.values, key)
+	self.lock.Unlock()
+}
+
+// children sorted by label values
+func (self *metricVec) sorted() (values [][]string, children []interface{}) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	keys := make([]string, 0, len(self.children))
+	for key := range self.children {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		values = append(values, self.values[key])
+		children = append(children, self.children[key])
+	}
+	return
+}
+
+func writeHeader(w io.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func writeSample(w io.Writer, name string, labels []string, values []string, v float64) {
+	fmt.Fprintf(w, "%s%s %s\n", name, labelString(labels, values), formatFloat(v))
+}
+
+// label values are escaped as the text format requires, other characters are written as they are in utf8
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func labelString(labels []string, values []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(labels))
+	for i, label := range labels {
+		pairs[i] = label + "=\"" + labelValueEscaper.Replace(values[i]) + "\""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+type CounterVec struct {
+	metricVec
+}
+
+func (self *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	vec := &CounterVec{newMetricVec(name, help, "counter", labels)}
+	self.register(vec)
+	return vec
+}
+
+func (self *CounterVec) With(values ...string) *Counter {
+	return self.child(values, func() interface{} { return new(Counter) }).(*Counter)
+}
+
+func (self *CounterVec) collect(w io.Writer) {
+	writeHeader(w, self.name, self.help, self.kind)
+	values, children := self.sorted()
+	for i, c := range children {
+		writeSample(w, self.name, self.labels, values[i], float64(c.(*Counter).Value()))
+	}
+}
+
+type HistogramVec struct {
+	metricVec
+	bounds []float64
+}
+
+func (self *Registry) NewHistogramVec(name, help string, bounds []float64, labels ...string) *HistogramVec {
+	vec := &HistogramVec{newMetricVec(name, help, "histogram", labels), bounds}
+	self.register(vec)
+	return vec
+}
+
+func (self *HistogramVec) With(values ...string) *Histogram {
+	return self.child(values, func() interface{} {
+		return &Histogram{bounds: self.bounds, counts: make([]uint64, len(self.bounds))}
+	}).(*Histogram)
+}
+
+func (self *HistogramVec) collect(w io.Writer) {
+	writeHeader(w, self.name, self.help, self.kind)
+	labels := append(append([]string(nil), self.labels...), "le")
+	values, children := self.sorted()
+	for i, c := range children {
+		h := c.(*Histogram)
+		h.lock.Lock()
+		bucket := append(append([]string(nil), values[i]...), "")
+		cumulative := uint64(0)
+		for j, bound := range h.bounds {
+			cumulative += h.counts[j]
+			bucket[len(bucket)-1] = formatFloat(bound)
+			writeSample(w, self.name+"_bucket", labels, bucket, float64(cumulative))
+		}
+		bucket[len(bucket)-1] = "+Inf"
+		writeSample(w, self.name+"_bucket", labels, bucket, float64(h.count))
+		writeSample(w, self.name+"_sum", self.labels, values[i], h.sum)
+		writeSample(w, self.name+"_count", self.labels, values[i], float64(h.count))
+		h.lock.Unlock()
+	}
+}
+
+// metrics read when collected, from state kept elsewhere
+type funcCollector struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+	f      func(emit func(v float64, values ...string))
+}
+
+// f calls emit once for each set of label values
+func (self *Registry) NewGaugeFunc(name, help string, labels []string, f func(emit func(v float64, values ...string))) {
+	self.register(&funcCollector{name, help, "gauge", labels, f})
+}
+
+func (self *Registry) NewCounterFunc(name, help string, labels []string, f func(emit func(v float64, values ...string))) {
+	self.register(&funcCollector{name, help, "counter", labels, f})
+}
+
+func (self *funcCollector) collect(w io.Writer) {
+	writeHeader(w, self.name, self.help, self.kind)
+	self.f(func(v float64, values ...string) {
+		writeSample(w, self.name, self.labels, values, v)
+	})
+}
@@ -0,0 +1,51 @@
+package util
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestMetricsText(t *testing.T) {
+	var registry Registry
+	events := registry.NewCounterVec("events_total", "Events.", "upstream")
+	events.With("b").Add(3)
+	events.With("a").Inc()
+	latency := registry.NewHistogramVec("latency_seconds", "Latency.", []float64{0.1, 1}, "upstream")
+	latency.With("a").Observe(0.05)
+	latency.With("a").Observe(0.5)
+	latency.With("a").Observe(2)
+	registry.NewGaugeFunc("peers", "Peers.", nil, func(emit func(v float64, values ...string)) {
+		emit(2)
+	})
+
+	var buffer bytes.Buffer
+	registry.WriteTo(&buffer)
+	expected := strings.Join([]string{
+		"# HELP events_total Events.",
+		"# TYPE events_total counter",
+		`events_total{upstream="a"} 1`,
+		`events_total{upstream="b"} 3`,
+		"# HELP latency_seconds Latency.",
+		"# TYPE latency_seconds histogram",
+		`latency_seconds_bucket{upstream="a",le="0.1"} 1`,
+		`latency_seconds_bucket{upstream="a",le="1"} 2`,
+		`latency_seconds_bucket{upstream="a",le="+Inf"} 3`,
+		`latency_seconds_sum{upstream="a"} 2.55`,
+		`latency_seconds_count{upstream="a"} 3`,
+		"# HELP peers Peers.",
+		"# TYPE peers gauge",
+		"peers 2",
+		"",
+	}, "\n")
+	if buffer.String() != expected {
+		t.Errorf("metrics:\n%s", buffer.String())
+	}
+}
+
+func TestLabelString(t *testing.T) {
+	s := labelString([]string{"binlog", "upstream"}, []string{"a\\b\"c\nd", "上游\t1"})
+	if s != `{binlog="a\\b\"c\nd",upstream="上游`+"\t"+`1"}` {
+		t.Errorf("labels %s", s)
+	}
+}